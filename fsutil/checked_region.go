@@ -0,0 +1,129 @@
+package fsutil
+
+// CheckedRegion is a view of a Region whose accessors return an
+// *OutOfBoundsError, rather than panicking, when asked to access bytes
+// outside of the region.
+type CheckedRegion struct {
+	Region Region
+}
+
+// Checked returns a CheckedRegion for the receiver.
+func (r Region) Checked() CheckedRegion {
+	return CheckedRegion{r}
+}
+
+func (c CheckedRegion) Length() int {
+	return c.Region.Length()
+}
+
+func (c CheckedRegion) Slice(offset, length int) (CheckedRegion, error) {
+	if err := c.Region.Check(offset, length); err != nil {
+		return CheckedRegion{}, err
+	}
+	return CheckedRegion{c.Region.Slice(offset, length)}, nil
+}
+
+func (c CheckedRegion) WriteU8(addr int, val byte) error {
+	return c.WriteLE(addr, 1, uint64(val))
+}
+
+func (c CheckedRegion) ReadU8(addr int) (byte, error) {
+	val, err := c.ReadLE(addr, 1)
+	return byte(val), err
+}
+
+func (c CheckedRegion) WriteLE(addr int, bytes int, val uint64) error {
+	if err := c.Region.Check(addr, bytes); err != nil {
+		return err
+	}
+	c.Region.WriteLE(addr, bytes, val)
+	return nil
+}
+
+func (c CheckedRegion) ReadLE(addr int, bytes int) (uint64, error) {
+	if err := c.Region.Check(addr, bytes); err != nil {
+		return 0, err
+	}
+	return c.Region.ReadLE(addr, bytes), nil
+}
+
+func (c CheckedRegion) WriteBE(addr int, bytes int, val uint64) error {
+	if err := c.Region.Check(addr, bytes); err != nil {
+		return err
+	}
+	c.Region.WriteBE(addr, bytes, val)
+	return nil
+}
+
+func (c CheckedRegion) ReadBE(addr int, bytes int) (uint64, error) {
+	if err := c.Region.Check(addr, bytes); err != nil {
+		return 0, err
+	}
+	return c.Region.ReadBE(addr, bytes), nil
+}
+
+func (c CheckedRegion) WriteU16LE(addr int, val uint16) error {
+	return c.WriteLE(addr, 2, uint64(val))
+}
+
+func (c CheckedRegion) ReadU16LE(addr int) (uint16, error) {
+	val, err := c.ReadLE(addr, 2)
+	return uint16(val), err
+}
+
+func (c CheckedRegion) WriteU32LE(addr int, val uint32) error {
+	return c.WriteLE(addr, 4, uint64(val))
+}
+
+func (c CheckedRegion) ReadU32LE(addr int) (uint32, error) {
+	val, err := c.ReadLE(addr, 4)
+	return uint32(val), err
+}
+
+func (c CheckedRegion) WriteU64LE(addr int, val uint64) error {
+	return c.WriteLE(addr, 8, val)
+}
+
+func (c CheckedRegion) ReadU64LE(addr int) (uint64, error) {
+	return c.ReadLE(addr, 8)
+}
+
+func (c CheckedRegion) WriteU16BE(addr int, val uint16) error {
+	return c.WriteBE(addr, 2, uint64(val))
+}
+
+func (c CheckedRegion) ReadU16BE(addr int) (uint16, error) {
+	val, err := c.ReadBE(addr, 2)
+	return uint16(val), err
+}
+
+func (c CheckedRegion) WriteU32BE(addr int, val uint32) error {
+	return c.WriteBE(addr, 4, uint64(val))
+}
+
+func (c CheckedRegion) ReadU32BE(addr int) (uint32, error) {
+	val, err := c.ReadBE(addr, 4)
+	return uint32(val), err
+}
+
+func (c CheckedRegion) WriteU64BE(addr int, val uint64) error {
+	return c.WriteBE(addr, 8, val)
+}
+
+func (c CheckedRegion) ReadU64BE(addr int) (uint64, error) {
+	return c.ReadBE(addr, 8)
+}
+
+// WriteBytes writes all of the given bytes at the given address, or
+// returns an error without writing anything if they don't all fit.
+func (c CheckedRegion) WriteBytes(start int, src []byte) error {
+	if err := c.Region.Check(start, len(src)); err != nil {
+		return err
+	}
+	c.Region.WriteBytes(start, src)
+	return nil
+}
+
+func (c CheckedRegion) WriteSubregion(addr int, builder RegionBuilder) error {
+	return c.Region.WriteSubregion(addr, builder)
+}
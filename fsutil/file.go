@@ -1,6 +1,7 @@
 package fsutil
 
 import (
+	"fmt"
 	"os"
 
 	"github.com/edsrzf/mmap-go"
@@ -15,14 +16,168 @@ const (
 	Executable  Protection = mmap.EXEC
 )
 
+// openFlag returns the flag for os.OpenFile that opens a file with the
+// access needed to map it with this protection.
+func (p Protection) openFlag() int {
+	switch {
+	case p&CopyOnWrite != 0:
+		// Changes to a copy-on-write mapping are never written back to
+		// the file, so we only need to be able to read it.
+		return os.O_RDONLY
+	case p&ReadWrite != 0:
+		return os.O_RDWR
+	default:
+		return os.O_RDONLY
+	}
+}
+
+// A RegionFile is a Region mapped from a file. It owns both the file and
+// its mappings, and releases them when closed.
 type RegionFile struct {
 	Region Region
+
+	file *os.File
+	maps []mmap.MMap
+	prot Protection
+
+	// ranged is set if only part of the file is mapped.
+	ranged bool
 }
 
+// Close unmaps the file and then closes it. The Region must not be used
+// after the file is closed.
 func (rf *RegionFile) Close() error {
-	return (*mmap.MMap)(&(rf.Region[0])).Unmap()
+	var firstErr error
+	for i := range rf.maps {
+		if err := rf.maps[i].Unmap(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	rf.maps = nil
+	rf.Region = nil
+
+	if rf.file != nil {
+		if err := rf.file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		rf.file = nil
+	}
+	return firstErr
+}
+
+// Flush writes any changes made through the Region back to the file,
+// waiting until they have been written.
+func (rf *RegionFile) Flush() error {
+	for _, m := range rf.maps {
+		if err := m.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sync is like Flush, but additionally commits the file to stable storage
+// in the same way as os.File.Sync, so that the changes will survive a
+// system crash.
+func (rf *RegionFile) Sync() error {
+	if err := rf.Flush(); err != nil {
+		return err
+	}
+	return rf.file.Sync()
 }
 
+// Resize changes the size of the file to the given number of bytes, either
+// truncating it or extending it with zero bytes, and then maps it again.
+//
+// Afterwards, the Region field describes the file at its new size. The
+// previous Region, and any Region sliced from it, must not be used again:
+// the file may have been mapped at a different address, and accessing the
+// old mapping can crash the program. On Linux the mapping is resized in
+// place where possible using mremap, while on other systems the file is
+// always mapped again.
+//
+// If Resize fails to map the file at its new size then the previous Region
+// remains valid, and the file keeps its previous size unless restoring it
+// also fails, in which case the returned error says so.
+//
+// Only RegionFiles that map an entire file with ReadWrite protection can
+// be resized.
+func (rf *RegionFile) Resize(size int) error {
+	if rf.ranged {
+		return fmt.Errorf("can't resize a mapping of only part of a file")
+	}
+	if rf.prot&ReadWrite == 0 || rf.prot&CopyOnWrite != 0 {
+		return fmt.Errorf("can't resize a file that isn't mapped for writing")
+	}
+	if size < 0 {
+		return fmt.Errorf("can't resize a file to %d bytes", size)
+	}
+
+	// A file grows before its mapping does, and shrinks after, so that
+	// the mapping never extends beyond the end of the file and so that
+	// we haven't discarded anything if we fail to change the mapping.
+	oldSize := rf.Region.Length()
+	grow := size > oldSize
+	if grow {
+		if err := rf.file.Truncate(int64(size)); err != nil {
+			return err
+		}
+	} else {
+		// Make sure that the content we're keeping has been written back
+		// before the file's length changes underneath its mapping.
+		if err := rf.Flush(); err != nil {
+			return err
+		}
+	}
+
+	var m mmap.MMap
+	var err error
+	switch {
+	case len(rf.maps) == 0:
+		if size == 0 {
+			return nil
+		}
+		m, err = mmap.Map(rf.file, int(rf.prot), 0)
+	case size == 0:
+		// An empty file can't be mapped at all.
+		err = rf.maps[0].Unmap()
+	default:
+		m, err = resizeMapping(rf.maps[0], rf.file, rf.prot, size)
+	}
+	if err != nil {
+		// The old mapping is still valid, so we restore the file's old
+		// length to avoid leaving it extended by a failed resize.
+		if grow {
+			if truncErr := rf.file.Truncate(int64(oldSize)); truncErr != nil {
+				return fmt.Errorf("%w (and failed to restore the previous file size: %s)", err, truncErr)
+			}
+		}
+		return err
+	}
+
+	rf.maps = nil
+	rf.Region = nil
+	if m != nil {
+		rf.maps = []mmap.MMap{m}
+		rf.Region = RegionForBytes([]byte(m))
+	}
+	if !grow {
+		return rf.file.Truncate(int64(size))
+	}
+	return nil
+}
+
+// resizeMapping is remap, unless a test has replaced it to simulate a
+// failure.
+var resizeMapping = remap
+
+// File returns the underlying file.
+func (rf *RegionFile) File() *os.File {
+	return rf.file
+}
+
+// RegionForFile maps the entire given file into memory. The returned
+// RegionFile takes ownership of the file, which is closed along with it.
 func RegionForFile(f *os.File, prot Protection) (RegionFile, error) {
 	buf, err := mmap.Map(f, int(prot), 0)
 	if err != nil {
@@ -30,7 +185,40 @@ func RegionForFile(f *os.File, prot Protection) (RegionFile, error) {
 	}
 
 	return RegionFile{
-		RegionForBytes([]byte(buf)),
+		Region: RegionForBytes([]byte(buf)),
+		file:   f,
+		maps:   []mmap.MMap{buf},
+		prot:   prot,
+	}, nil
+}
+
+// RegionForFileRange maps length bytes of the given file, starting at the
+// given offset, into memory. This allows working with part of a file that
+// is too large to map in full.
+//
+// The offset need not be a multiple of the system's page size. The
+// returned RegionFile takes ownership of the file, which is closed along
+// with it.
+func RegionForFileRange(f *os.File, prot Protection, offset int64, length int) (RegionFile, error) {
+	if offset < 0 || length <= 0 {
+		return RegionFile{}, fmt.Errorf("can't map %d bytes at offset %d", length, offset)
+	}
+
+	// The mapping itself must begin on a page boundary, so we map some
+	// extra bytes before the offset and then leave them out of the Region.
+	pageSize := int64(os.Getpagesize())
+	skip := int(offset % pageSize)
+	buf, err := mmap.MapRegion(f, skip+length, int(prot), 0, offset-int64(skip))
+	if err != nil {
+		return RegionFile{}, err
+	}
+
+	return RegionFile{
+		Region: RegionForBytes([]byte(buf[skip:])),
+		file:   f,
+		maps:   []mmap.MMap{buf},
+		prot:   prot,
+		ranged: true,
 	}, nil
 }
 
@@ -42,30 +230,128 @@ func CreateFile(fn string, size int) (RegionFile, error) {
 
 	err = f.Truncate(int64(size))
 	if err != nil {
+		f.Close()
 		return RegionFile{}, err
 	}
 
-	return RegionForFile(f, ReadWrite)
+	rf, err := RegionForFile(f, ReadWrite)
+	if err != nil {
+		f.Close()
+	}
+	return rf, err
 }
 
+// OpenFile opens the named file with the access needed for the given
+// protection and maps it into memory.
+//
+// With ReadWrite, changes made through the Region are written back to the
+// file. With CopyOnWrite, the Region may be modified but the changes are
+// private to this process and are discarded when it is closed.
 func OpenFile(fn string, prot Protection) (RegionFile, error) {
-	f, err := os.Open(fn)
+	f, err := os.OpenFile(fn, prot.openFlag(), 0)
+	if err != nil {
+		return RegionFile{}, err
+	}
+
+	rf, err := RegionForFile(f, prot)
+	if err != nil {
+		f.Close()
+	}
+	return rf, err
+}
+
+// OpenFileRange is like OpenFile, but maps only length bytes of the file
+// starting at the given offset. See RegionForFileRange.
+func OpenFileRange(fn string, prot Protection, offset int64, length int) (RegionFile, error) {
+	f, err := os.OpenFile(fn, prot.openFlag(), 0)
 	if err != nil {
 		return RegionFile{}, err
 	}
 
-	return RegionForFile(f, prot)
+	rf, err := RegionForFileRange(f, prot, offset, length)
+	if err != nil {
+		f.Close()
+	}
+	return rf, err
 }
 
+// BuildFile creates a file of the builder's length and builds the builder
+// into it. If the builder fails, the partially-written file is removed and
+// the builder's error is returned.
+//
+// If the builder is a SparseRegionBuilder then its zero ranges are left
+// unwritten, so that on filesystems that support sparse files they occupy
+// no storage. FileUsage reports how much storage the result occupies.
 func BuildFile(fn string, builder RegionBuilder) error {
 	size := builder.Length()
 
+	if size == 0 {
+		// An empty file can't be mapped, but the builder may still have
+		// an error to report.
+		f, err := os.Create(fn)
+		if err != nil {
+			return err
+		}
+		f.Close()
+		if err := builder.Build(Region{}); err != nil {
+			os.Remove(fn)
+			return err
+		}
+		return nil
+	}
+
+	if zeros := ZeroRanges(builder); len(zeros) > 0 {
+		return buildFileSparse(fn, builder, zeros)
+	}
+
 	rf, err := CreateFile(fn, size)
 	if err != nil {
 		return err
 	}
 
-	builder.Build(rf.Region)
+	if err := builder.Build(rf.Region); err != nil {
+		rf.Close()
+		os.Remove(fn)
+		return err
+	}
 
 	return rf.Close()
 }
+
+func buildFileSparse(fn string, builder RegionBuilder, zeros []ByteRange) error {
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+
+	// Extending the file with Truncate, rather than by writing, leaves a
+	// hole on filesystems that support them, which we then write the
+	// non-zero parts of the content into.
+	err = f.Truncate(int64(builder.Length()))
+	if err == nil {
+		err = buildSparseFile(f, builder, zeros)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(fn)
+		return err
+	}
+
+	return f.Close()
+}
+
+// remapByMapping replaces the given mapping with a new mapping of the first
+// size bytes of the given file.
+func remapByMapping(m mmap.MMap, f *os.File, prot Protection, size int) (mmap.MMap, error) {
+	// We map the file again before unmapping the old mapping, so that the
+	// old one is still valid if we fail.
+	newMap, err := mmap.MapRegion(f, size, int(prot), 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.Unmap(); err != nil {
+		newMap.Unmap()
+		return nil, err
+	}
+	return newMap, nil
+}
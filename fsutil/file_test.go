@@ -1,8 +1,14 @@
 package fsutil
 
 import (
-	_ "reflect"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
 	"testing"
+
+	"github.com/edsrzf/mmap-go"
 )
 
 func TestOpen(t *testing.T) {
@@ -22,3 +28,276 @@ func TestOpen(t *testing.T) {
 		t.Errorf("failed to close file: %s", err)
 	}
 }
+
+type failingRegionBuilder struct {
+	err error
+}
+
+func (rb *failingRegionBuilder) Length() int {
+	return 16
+}
+
+func (rb *failingRegionBuilder) Build(r Region) error {
+	return rb.err
+}
+
+func TestBuildFileError(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "out.bin")
+	want := errors.New("build failed")
+
+	err := BuildFile(fn, &failingRegionBuilder{want})
+	if err != want {
+		t.Errorf("error is %#v; want %#v", err, want)
+	}
+	if _, err := os.Stat(fn); !os.IsNotExist(err) {
+		t.Errorf("partially-built file was not removed")
+	}
+}
+
+func TestBuildFileSparse(t *testing.T) {
+	dir := t.TempDir()
+	const zeroSize = 4 << 20
+
+	builder := &ConcatRegionBuilder{
+		Builders: []RegionBuilder{
+			&BufferRegionBuilder{Buffer: []byte("head")},
+			&ZeroRegionBuilder{Size: zeroSize},
+			&AlignRegionBuilder{
+				Builder:  &BufferRegionBuilder{Buffer: []byte("tail")},
+				Boundary: 4096,
+			},
+		},
+	}
+	want := make([]byte, builder.Length())
+	if err := builder.Build(RegionForBytes(want)); err != nil {
+		t.Fatal(err)
+	}
+
+	fn := filepath.Join(dir, "out.bin")
+	if err := BuildFile(fn, builder); err != nil {
+		t.Fatalf("failed to build file: %s", err)
+	}
+	got, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(want) {
+		t.Fatalf("file content differs from built content")
+	}
+
+	// Not all filesystems support sparse files, so we only check the
+	// allocated size if a newly-extended file is sparse.
+	probe := filepath.Join(dir, "probe.bin")
+	f, err := os.Create(probe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Truncate(zeroSize)
+	f.Close()
+	if _, allocated, err := FileUsage(probe); err != nil || allocated >= zeroSize {
+		t.Skip("temporary directory does not support sparse files")
+	}
+
+	apparent, allocated, err := FileUsage(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if apparent != int64(len(want)) {
+		t.Errorf("apparent size is %d; want %d", apparent, len(want))
+	}
+	if allocated >= zeroSize {
+		t.Errorf("allocated size is %d; want less than %d", allocated, zeroSize)
+	}
+}
+
+func TestZeroRanges(t *testing.T) {
+	builder := &PlacedRegionBuilder{
+		Placements: []Placement{
+			{Offset: 8, Builder: &ZeroRegionBuilder{Size: 2}},
+			{Offset: 2, Builder: &BufferRegionBuilder{Buffer: []byte("abc")}},
+		},
+		Size: 12,
+	}
+	got := ZeroRanges(builder)
+	want := []ByteRange{
+		{Offset: 0, Length: 2},
+		{Offset: 5, Length: 7},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("zero ranges are %#v; want %#v", got, want)
+	}
+}
+
+func TestOpenFileRange(t *testing.T) {
+	rf, err := OpenFileRange("testdata/test.bin", ReadOnly, 8, 2)
+	if err != nil {
+		t.Fatalf("failed to open file: %s", err)
+	}
+	defer rf.Close()
+
+	if got, want := rf.Region.Length(), 2; got != want {
+		t.Errorf("region has length %d; want %d", got, want)
+	}
+	if got, want := rf.Region.ReadU16BE(0), uint16(0xbead); got != want {
+		t.Errorf("got 0x%04x from file; want 0x%04x", got, want)
+	}
+}
+
+func TestRegionFileSync(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "out.bin")
+	rf, err := CreateFile(fn, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rf.Region.WriteBytes(4, []byte("synced"))
+	if err := rf.Sync(); err != nil {
+		t.Fatalf("failed to sync: %s", err)
+	}
+
+	got, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "\x00\x00\x00\x00synced\x00\x00\x00\x00\x00\x00"; string(got) != want {
+		t.Errorf("file contains %q; want %q", got, want)
+	}
+
+	f := rf.File()
+	if err := rf.Close(); err != nil {
+		t.Fatalf("failed to close: %s", err)
+	}
+	if _, err := f.Stat(); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("file was not closed")
+	}
+}
+
+func TestOpenFileProtection(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "image.bin")
+	if err := os.WriteFile(fn, []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		prot Protection
+		want string
+	}{
+		{CopyOnWrite, "original"},
+		{ReadWrite, "modified"},
+	}
+
+	for _, test := range tests {
+		rf, err := OpenFile(fn, test.prot)
+		if err != nil {
+			t.Fatalf("failed to open file with protection %d: %s", test.prot, err)
+		}
+		rf.Region.WriteBytes(0, []byte("modified"))
+		if got := string(rf.Region.Bytes()); got != "modified" {
+			t.Errorf("region contains %q after writing; want %q", got, "modified")
+		}
+		if err := rf.Close(); err != nil {
+			t.Fatalf("failed to close file: %s", err)
+		}
+
+		got, err := os.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != test.want {
+			t.Errorf("file contains %q with protection %d; want %q", got, test.prot, test.want)
+		}
+	}
+}
+
+func TestRegionFileResize(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "out.bin")
+	rf, err := CreateFile(fn, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+	rf.Region.WriteBytes(0, []byte("head"))
+
+	steps := []struct {
+		size int
+		want string
+	}{
+		{1 << 20, "head"},
+		{6, "head\x00\x00"},
+		{2, "he"},
+		{0, ""},
+		{3, "\x00\x00\x00"},
+	}
+	for _, step := range steps {
+		if err := rf.Resize(step.size); err != nil {
+			t.Fatalf("failed to resize to %d bytes: %s", step.size, err)
+		}
+		if got, want := rf.Region.Length(), step.size; got != want {
+			t.Errorf("region has length %d after resizing; want %d", got, want)
+			continue
+		}
+		if got := string(rf.Region.Slice(0, len(step.want)).Bytes()); got != step.want {
+			t.Errorf("region begins with %q after resizing to %d bytes; want %q", got, step.size, step.want)
+		}
+		if step.size == 1<<20 {
+			// The newly-extended area must be writable.
+			rf.Region.WriteU8(step.size-1, 0xff)
+		}
+	}
+
+	if err := rf.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(fn); err != nil || info.Size() != 3 {
+		t.Errorf("file was not resized")
+	}
+
+	cow, err := OpenFile(fn, CopyOnWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cow.Close()
+	if err := cow.Resize(10); err == nil {
+		t.Errorf("succeeded in resizing a copy-on-write mapping; want error")
+	}
+}
+
+func TestRegionFileResizeFailure(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "out.bin")
+	rf, err := CreateFile(fn, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+	rf.Region.WriteBytes(0, []byte("keep"))
+
+	// mremap can fail, such as with ENOMEM, leaving the old mapping as it
+	// was, but it's hard to make it do so on demand.
+	defer func(orig func(mmap.MMap, *os.File, Protection, int) (mmap.MMap, error)) {
+		resizeMapping = orig
+	}(resizeMapping)
+	resizeMapping = func(mmap.MMap, *os.File, Protection, int) (mmap.MMap, error) {
+		return nil, syscall.ENOMEM
+	}
+
+	for _, size := range []int{2, 1 << 20} {
+		if err := rf.Resize(size); err != syscall.ENOMEM {
+			t.Errorf("error resizing to %d bytes is %#v; want ENOMEM", size, err)
+		}
+		if got, want := string(rf.Region.Bytes()), "keep"; got != want {
+			t.Errorf("region contains %q after failing to resize to %d bytes; want %q", got, size, want)
+		}
+		if info, err := os.Stat(fn); err != nil || info.Size() != 4 {
+			t.Errorf("file length was not restored after failing to resize to %d bytes", size)
+		}
+	}
+
+	// The old mapping must still be the one that Close unmaps.
+	rf.Region.WriteBytes(0, []byte("done"))
+	if err := rf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(fn); err != nil || string(got) != "done" {
+		t.Errorf("file contains %q; want %q", got, "done")
+	}
+}
@@ -0,0 +1,234 @@
+package fsutil
+
+import (
+	"io"
+)
+
+// IndexedRegion is a Region along with an index of the offset where each of
+// its buffers begins, which allows it to locate a particular byte by binary
+// search rather than by scanning all of the buffers.
+//
+// Building the index takes time proportional to the number of buffers, so
+// this is worthwhile only for fragmented regions that will be accessed many
+// times, such as a file whose content is spread over many clusters.
+//
+// The index describes the buffers as they were when it was built, so the
+// Region must not be resliced or have its buffers replaced afterwards,
+// though the content of those buffers may be freely modified.
+type IndexedRegion struct {
+	Region Region
+
+	// starts[i] is the offset of the first byte of Region[i], with an
+	// additional final element giving the total length.
+	starts []int
+}
+
+var (
+	_ io.ReaderAt = (*IndexedRegion)(nil)
+	_ io.WriterAt = (*IndexedRegion)(nil)
+)
+
+// Indexed builds an index of the region's buffers, returning an
+// IndexedRegion that can be used to access it more efficiently.
+func (r Region) Indexed() *IndexedRegion {
+	starts := make([]int, len(r)+1)
+	for i, buf := range r {
+		starts[i+1] = starts[i] + len(buf)
+	}
+	return &IndexedRegion{
+		Region: r,
+		starts: starts,
+	}
+}
+
+func (r *IndexedRegion) Length() int {
+	return r.starts[len(r.starts)-1]
+}
+
+// locate finds the buffer containing the byte at the given address, and
+// the offset of that byte within the buffer, by binary search.
+func (r *IndexedRegion) locate(addr int) (int, int, bool) {
+	if addr < 0 || addr >= r.Length() {
+		return 0, 0, false
+	}
+
+	// Find the last buffer that starts at or before addr. Empty buffers
+	// start at the same offset as the buffer that follows them, so this
+	// always selects a buffer that contains addr.
+	lo, hi := 0, len(r.Region)-1
+	for lo < hi {
+		mid := lo + (hi-lo+1)/2
+		if r.starts[mid] <= addr {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	return lo, addr - r.starts[lo], true
+}
+
+func (r *IndexedRegion) mustLocate(addr, length int) (int, int) {
+	if length == 0 {
+		return 0, 0
+	}
+	if err := r.Check(addr, length); err != nil {
+		panic(err)
+	}
+	i, ofs, _ := r.locate(addr)
+	return i, ofs
+}
+
+// Check returns an *OutOfBoundsError if the given number of bytes at the
+// given offset are not entirely within the region, or nil otherwise.
+func (r *IndexedRegion) Check(offset, length int) error {
+	regionLen := r.Length()
+	if offset < 0 || length < 0 || offset > regionLen || length > regionLen-offset {
+		return &OutOfBoundsError{
+			Offset:       offset,
+			Length:       length,
+			RegionLength: regionLen,
+		}
+	}
+	return nil
+}
+
+// Slice returns a Region covering the given part of the indexed region,
+// following the same rules as Region.Slice.
+func (r *IndexedRegion) Slice(offset, length int) Region {
+	i, ofs, ok := r.locate(offset)
+	if !ok {
+		return make([][]byte, 0)
+	}
+	return r.Region[i:].Slice(ofs, length)
+}
+
+// Blocks is like Region.Blocks, but locates each block by binary search.
+func (r *IndexedRegion) Blocks(size int, mapping []int) Region {
+	ret := make([][]byte, 0, len(mapping))
+
+	for _, destBlock := range mapping {
+		ret = append(ret, r.Slice(destBlock*size, size)...)
+	}
+
+	return ret
+}
+
+func (r *IndexedRegion) Bytes() []byte {
+	ret := make([]byte, r.Length())
+	copyOut(r.Region, 0, 0, ret)
+	return ret
+}
+
+func (r *IndexedRegion) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, &OutOfBoundsError{
+			Offset:       int(off),
+			Length:       len(p),
+			RegionLength: r.Length(),
+		}
+	}
+
+	n := 0
+	if i, ofs, ok := r.locate(int(off)); ok {
+		n = copyOut(r.Region, i, ofs, p)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *IndexedRegion) WriteAt(p []byte, off int64) (int, error) {
+	err := r.Check(int(off), len(p))
+	n := 0
+	if i, ofs, ok := r.locate(int(off)); ok {
+		n = copyIn(r.Region, i, ofs, p)
+	}
+	return n, err
+}
+
+func (r *IndexedRegion) WriteBytes(start int, src []byte) int {
+	i, ofs, ok := r.locate(start)
+	if !ok {
+		return 0
+	}
+	return copyIn(r.Region, i, ofs, src)
+}
+
+func (r *IndexedRegion) WriteU8(addr int, val byte) {
+	i, ofs := r.mustLocate(addr, 1)
+	r.Region[i][ofs] = val
+}
+
+func (r *IndexedRegion) ReadU8(addr int) byte {
+	i, ofs := r.mustLocate(addr, 1)
+	return r.Region[i][ofs]
+}
+
+func (r *IndexedRegion) WriteLE(addr int, bytes int, val uint64) {
+	i, ofs := r.mustLocate(addr, bytes)
+	writeLEAt(r.Region, i, ofs, bytes, val)
+}
+
+func (r *IndexedRegion) ReadLE(addr int, bytes int) uint64 {
+	i, ofs := r.mustLocate(addr, bytes)
+	return readLEAt(r.Region, i, ofs, bytes)
+}
+
+func (r *IndexedRegion) WriteBE(addr int, bytes int, val uint64) {
+	i, ofs := r.mustLocate(addr, bytes)
+	writeBEAt(r.Region, i, ofs, bytes, val)
+}
+
+func (r *IndexedRegion) ReadBE(addr int, bytes int) uint64 {
+	i, ofs := r.mustLocate(addr, bytes)
+	return readBEAt(r.Region, i, ofs, bytes)
+}
+
+func (r *IndexedRegion) WriteU16LE(addr int, val uint16) {
+	r.WriteLE(addr, 2, uint64(val))
+}
+
+func (r *IndexedRegion) ReadU16LE(addr int) uint16 {
+	return uint16(r.ReadLE(addr, 2))
+}
+
+func (r *IndexedRegion) WriteU32LE(addr int, val uint32) {
+	r.WriteLE(addr, 4, uint64(val))
+}
+
+func (r *IndexedRegion) ReadU32LE(addr int) uint32 {
+	return uint32(r.ReadLE(addr, 4))
+}
+
+func (r *IndexedRegion) WriteU64LE(addr int, val uint64) {
+	r.WriteLE(addr, 8, val)
+}
+
+func (r *IndexedRegion) ReadU64LE(addr int) uint64 {
+	return r.ReadLE(addr, 8)
+}
+
+func (r *IndexedRegion) WriteU16BE(addr int, val uint16) {
+	r.WriteBE(addr, 2, uint64(val))
+}
+
+func (r *IndexedRegion) ReadU16BE(addr int) uint16 {
+	return uint16(r.ReadBE(addr, 2))
+}
+
+func (r *IndexedRegion) WriteU32BE(addr int, val uint32) {
+	r.WriteBE(addr, 4, uint64(val))
+}
+
+func (r *IndexedRegion) ReadU32BE(addr int) uint32 {
+	return uint32(r.ReadBE(addr, 4))
+}
+
+func (r *IndexedRegion) WriteU64BE(addr int, val uint64) {
+	r.WriteBE(addr, 8, val)
+}
+
+func (r *IndexedRegion) ReadU64BE(addr int) uint64 {
+	return r.ReadBE(addr, 8)
+}
@@ -0,0 +1,70 @@
+package fsutil
+
+import (
+	"reflect"
+	"testing"
+)
+
+func fragmentedTestRegion() Region {
+	var reg Region
+	for i := 0; i < 64; i++ {
+		// Buffers of varying sizes, including some empty ones.
+		buf := make([]byte, i%5)
+		for j := range buf {
+			buf[j] = byte(i*7 + j)
+		}
+		reg = append(reg, buf)
+	}
+	return reg
+}
+
+func TestIndexedRegion(t *testing.T) {
+	reg := fragmentedTestRegion()
+	idx := reg.Indexed()
+	flat := reg.Bytes()
+
+	if got, want := idx.Length(), len(flat); got != want {
+		t.Fatalf("Length is %d; want %d", got, want)
+	}
+	if got := idx.Bytes(); !reflect.DeepEqual(got, flat) {
+		t.Errorf("Bytes is %#v; want %#v", got, flat)
+	}
+
+	for addr := 0; addr+4 <= len(flat); addr++ {
+		if got, want := idx.ReadU32LE(addr), reg.ReadU32LE(addr); got != want {
+			t.Errorf("ReadU32LE(%d) is %08x; want %08x", addr, got, want)
+		}
+		if got, want := idx.ReadU32BE(addr), reg.ReadU32BE(addr); got != want {
+			t.Errorf("ReadU32BE(%d) is %08x; want %08x", addr, got, want)
+		}
+		if got, want := idx.Slice(addr, 4).Bytes(), flat[addr:addr+4]; !reflect.DeepEqual(got, want) {
+			t.Errorf("Slice(%d, 4) is %#v; want %#v", addr, got, want)
+		}
+	}
+
+	idx.WriteU32BE(9, 0xdeadbeef)
+	if got := reg.ReadU32BE(9); got != 0xdeadbeef {
+		t.Errorf("value written through index reads back as %08x; want deadbeef", got)
+	}
+
+	defer func() {
+		want := &OutOfBoundsError{Offset: len(flat) - 1, Length: 2, RegionLength: len(flat)}
+		if got := recover(); !reflect.DeepEqual(got, want) {
+			t.Errorf("panic value is %#v; want %#v", got, want)
+		}
+	}()
+	idx.ReadU16LE(len(flat) - 1)
+}
+
+func TestReadAllocations(t *testing.T) {
+	reg := fragmentedTestRegion()
+	idx := reg.Indexed()
+
+	allocs := testing.AllocsPerRun(100, func() {
+		reg.WriteU32LE(13, reg.ReadU32LE(11))
+		idx.WriteU32LE(13, idx.ReadU32LE(11))
+	})
+	if allocs != 0 {
+		t.Errorf("fixed-width access makes %v allocations; want 0", allocs)
+	}
+}
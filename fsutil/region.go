@@ -1,5 +1,9 @@
 package fsutil
 
+import (
+	"fmt"
+)
+
 // Region projects a flat, contiguous address space onto arbitrary segments
 // of one or more underlying buffers.
 //
@@ -11,14 +15,15 @@ package fsutil
 // The arbitrary sizing comes at the cost of needing to scan through the
 // buffers linearly in order to locate a particular byte. As a consequence,
 // it works best to keep the total number of buffers small. When working
-// with a very fragmented region, it is a good idea to Slice a smaller part
-// to do a number of related operations, since those operations will then
-// scan only the relevant sub-slices.
+// with a very fragmented region, such as one returned by Blocks, use
+// Indexed to obtain an IndexedRegion that can locate bytes by binary
+// search instead.
 type Region [][]byte
 
-// (maybe later we'll impose a requirement that all buffers except the first
-// and last must be the same length, in which case we can avoid the need to
-// scan.)
+// The Read and Write methods of Region panic with an *OutOfBoundsError if
+// asked to access bytes outside of the region. Callers that cannot
+// guarantee their addresses are in range can either use Check first or
+// use the methods of CheckedRegion, which return the error instead.
 
 func RegionForBytes(src []byte) Region {
 	return Region([][]byte{
@@ -30,6 +35,155 @@ func RegionFromString(src string) Region {
 	return RegionForBytes([]byte(src))
 }
 
+// OutOfBoundsError is the error used when an operation refers to bytes
+// that are outside of a region.
+type OutOfBoundsError struct {
+	Offset       int
+	Length       int
+	RegionLength int
+}
+
+func (err *OutOfBoundsError) Error() string {
+	return fmt.Sprintf(
+		"%d bytes at offset %d are outside of a region of %d bytes",
+		err.Length, err.Offset, err.RegionLength,
+	)
+}
+
+// Check returns an *OutOfBoundsError if the given number of bytes at the
+// given offset are not entirely within the region, or nil otherwise.
+func (r Region) Check(offset, length int) error {
+	regionLen := r.Length()
+	if offset < 0 || length < 0 || offset > regionLen || length > regionLen-offset {
+		return &OutOfBoundsError{
+			Offset:       offset,
+			Length:       length,
+			RegionLength: regionLen,
+		}
+	}
+	return nil
+}
+
+func (r Region) outOfBounds(offset, length int) *OutOfBoundsError {
+	return &OutOfBoundsError{
+		Offset:       offset,
+		Length:       length,
+		RegionLength: r.Length(),
+	}
+}
+
+// locate finds the buffer containing the byte at the given address, and
+// the offset of that byte within the buffer, by scanning the buffers in
+// order.
+func (r Region) locate(addr int) (int, int, bool) {
+	if addr < 0 {
+		return 0, 0, false
+	}
+	for i, buf := range r {
+		if addr < len(buf) {
+			return i, addr, true
+		}
+		addr -= len(buf)
+	}
+	return 0, 0, false
+}
+
+// mustLocate is like locate, but also checks that the given number of
+// bytes are available from the address, and panics with an
+// *OutOfBoundsError if not.
+func (r Region) mustLocate(addr, length int) (int, int) {
+	if length == 0 {
+		return 0, 0
+	}
+	i, ofs, ok := r.locate(addr)
+	if !ok || !r.hasBytes(i, ofs, length) {
+		panic(r.outOfBounds(addr, length))
+	}
+	return i, ofs
+}
+
+// hasBytes returns true if the given number of bytes are available starting
+// at the given offset into buffer i.
+func (r Region) hasBytes(i, ofs, length int) bool {
+	avail := len(r[i]) - ofs
+	for avail < length {
+		i++
+		if i >= len(r) {
+			return false
+		}
+		avail += len(r[i])
+	}
+	return true
+}
+
+// The functions below access bytes starting at the given offset into buffer
+// i, moving on to subsequent buffers as necessary. The caller must already
+// have checked that enough bytes are available.
+
+func readLEAt(r Region, i, ofs, bytes int) uint64 {
+	val := uint64(0)
+	for k := 0; k < bytes; k++ {
+		for ofs == len(r[i]) {
+			i, ofs = i+1, 0
+		}
+		val |= uint64(r[i][ofs]) << (8 * uint(k))
+		ofs++
+	}
+	return val
+}
+
+func writeLEAt(r Region, i, ofs, bytes int, val uint64) {
+	for k := 0; k < bytes; k++ {
+		for ofs == len(r[i]) {
+			i, ofs = i+1, 0
+		}
+		r[i][ofs] = byte(val >> (8 * uint(k)))
+		ofs++
+	}
+}
+
+func readBEAt(r Region, i, ofs, bytes int) uint64 {
+	val := uint64(0)
+	for k := 0; k < bytes; k++ {
+		for ofs == len(r[i]) {
+			i, ofs = i+1, 0
+		}
+		val = (val << 8) | uint64(r[i][ofs])
+		ofs++
+	}
+	return val
+}
+
+func writeBEAt(r Region, i, ofs, bytes int, val uint64) {
+	for k := 0; k < bytes; k++ {
+		for ofs == len(r[i]) {
+			i, ofs = i+1, 0
+		}
+		r[i][ofs] = byte(val >> (8 * uint(bytes-1-k)))
+		ofs++
+	}
+}
+
+// copyOut copies bytes from the region into p until either p is full or
+// the region ends, returning the number of bytes copied.
+func copyOut(r Region, i, ofs int, p []byte) int {
+	n := 0
+	for ; i < len(r) && n < len(p); i, ofs = i+1, 0 {
+		n += copy(p[n:], r[i][ofs:])
+	}
+	return n
+}
+
+// copyIn copies bytes from p into the region until either all of p is
+// copied or the region ends, returning the number of bytes copied.
+func copyIn(r Region, i, ofs int, p []byte) int {
+	n := 0
+	for ; i < len(r) && n < len(p); i, ofs = i+1, 0 {
+		n += copy(r[i][ofs:], p[n:])
+	}
+	return n
+}
+
 func (r Region) Slice(offset, length int) Region {
 	// Search through our buffers to find the one that contains
 	// the start offset.
@@ -123,7 +277,7 @@ func (r Region) Bytes() []byte {
 	if len(r) > 2 {
 		// Second element is probably the same length as the remaining non-edge
 		// elements.
-		guessLen += len(r[1])*len(r) - 2
+		guessLen += len(r[1]) * (len(r) - 2)
 	}
 
 	ret := make([]byte, 0, guessLen)
@@ -134,50 +288,33 @@ func (r Region) Bytes() []byte {
 }
 
 func (r *Region) WriteU8(addr int, val byte) {
-	loc := r.Slice(addr, 1)
-	// If the caller has request a byte outside of the region
-	// then we'll fail here with an out-of-bounds error because
-	// the returned slice is empty.
-	loc[0][0] = val
+	i, ofs := r.mustLocate(addr, 1)
+	(*r)[i][ofs] = val
 }
 
 func (r *Region) ReadU8(addr int) byte {
-	loc := r.Slice(addr, 1)
-	return loc[0][0]
+	i, ofs := r.mustLocate(addr, 1)
+	return (*r)[i][ofs]
 }
 
 func (r *Region) WriteLE(addr int, bytes int, val uint64) {
-	loc := r.Slice(addr, bytes)
-	for ofs := 0; ofs < bytes; ofs++ {
-		loc.WriteU8(ofs, byte(val))
-		val = val >> 8
-	}
+	i, ofs := r.mustLocate(addr, bytes)
+	writeLEAt(*r, i, ofs, bytes, val)
 }
 
 func (r *Region) ReadLE(addr int, bytes int) uint64 {
-	loc := r.Slice(addr, bytes)
-	val := uint64(0)
-	for ofs := bytes - 1; ofs >= 0; ofs-- {
-		val = (val << 8) | uint64(loc.ReadU8(ofs))
-	}
-	return val
+	i, ofs := r.mustLocate(addr, bytes)
+	return readLEAt(*r, i, ofs, bytes)
 }
 
 func (r *Region) WriteBE(addr int, bytes int, val uint64) {
-	loc := r.Slice(addr, bytes)
-	for ofs := bytes - 1; ofs >= 0; ofs-- {
-		loc.WriteU8(ofs, byte(val))
-		val = val >> 8
-	}
+	i, ofs := r.mustLocate(addr, bytes)
+	writeBEAt(*r, i, ofs, bytes, val)
 }
 
 func (r *Region) ReadBE(addr int, bytes int) uint64 {
-	loc := r.Slice(addr, bytes)
-	val := uint64(0)
-	for ofs := 0; ofs < bytes; ofs++ {
-		val = (val << 8) | uint64(loc.ReadU8(ofs))
-	}
-	return val
+	i, ofs := r.mustLocate(addr, bytes)
+	return readBEAt(*r, i, ofs, bytes)
 }
 
 func (r *Region) WriteU16LE(addr int, val uint16) {
@@ -240,7 +377,13 @@ func (r *Region) WriteBytes(start int, src []byte) int {
 	return ofs
 }
 
-func (r *Region) WriteSubregion(addr int, builder RegionBuilder) {
+// WriteSubregion builds the given builder into the part of the region
+// that starts at the given address, returning any error from the builder
+// or an *OutOfBoundsError if the builder's content doesn't fit.
+func (r *Region) WriteSubregion(addr int, builder RegionBuilder) error {
 	length := builder.Length()
-	builder.Build(r.Slice(addr, length))
+	if err := r.Check(addr, length); err != nil {
+		return err
+	}
+	return builder.Build(r.Slice(addr, length))
 }
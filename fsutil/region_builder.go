@@ -1,10 +1,20 @@
 package fsutil
 
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
 // A RegionBuilder maps from some high-level structure, such as a list of
 // descriptions of files, onto some physical structure, like a filesystem.
+//
+// Build is given a region of exactly Length bytes to write into, and
+// returns an error if it is unable to produce the content of that region.
 type RegionBuilder interface {
 	Length() int
-	Build(Region)
+	Build(Region) error
 }
 
 // A BufferRegionBuilder builds a region from a fixed memory buffer.
@@ -16,6 +26,341 @@ func (rb *BufferRegionBuilder) Length() int {
 	return len(rb.Buffer)
 }
 
-func (rb *BufferRegionBuilder) Build(r Region) {
+func (rb *BufferRegionBuilder) Build(r Region) error {
+	if err := r.Check(0, len(rb.Buffer)); err != nil {
+		return err
+	}
 	r.WriteBytes(0, rb.Buffer)
+	return nil
+}
+
+func (rb *BufferRegionBuilder) PrepareRanges() (RangeBuilder, error) {
+	return rb, nil
+}
+
+func (rb *BufferRegionBuilder) BuildRange(r Region, offset int) error {
+	length := r.Length()
+	if err := checkRange(len(rb.Buffer), offset, length); err != nil {
+		return err
+	}
+	r.WriteBytes(0, rb.Buffer[offset:offset+length])
+	return nil
+}
+
+// zeroRegion sets all of the bytes in the given region to zero.
+func zeroRegion(r Region) {
+	for _, buf := range r {
+		for i := range buf {
+			buf[i] = 0
+		}
+	}
+}
+
+// A ZeroRegionBuilder builds a region of the given size containing only
+// zero bytes.
+type ZeroRegionBuilder struct {
+	Size int
+}
+
+func (rb *ZeroRegionBuilder) Length() int {
+	return rb.Size
+}
+
+func (rb *ZeroRegionBuilder) Build(r Region) error {
+	if err := r.Check(0, rb.Size); err != nil {
+		return err
+	}
+	return rb.BuildRange(r.Slice(0, rb.Size), 0)
+}
+
+func (rb *ZeroRegionBuilder) PrepareRanges() (RangeBuilder, error) {
+	return rb, nil
+}
+
+func (rb *ZeroRegionBuilder) BuildRange(r Region, offset int) error {
+	if err := checkRange(rb.Size, offset, r.Length()); err != nil {
+		return err
+	}
+	zeroRegion(r)
+	return nil
+}
+
+// A RepeatRegionBuilder builds a region of the given size by repeating a
+// pattern of bytes, truncating the final repetition if necessary.
+type RepeatRegionBuilder struct {
+	Pattern []byte
+	Size    int
+}
+
+func (rb *RepeatRegionBuilder) Length() int {
+	return rb.Size
+}
+
+func (rb *RepeatRegionBuilder) Build(r Region) error {
+	if err := r.Check(0, rb.Size); err != nil {
+		return err
+	}
+	return rb.BuildRange(r.Slice(0, rb.Size), 0)
+}
+
+func (rb *RepeatRegionBuilder) PrepareRanges() (RangeBuilder, error) {
+	return rb, nil
+}
+
+func (rb *RepeatRegionBuilder) BuildRange(r Region, offset int) error {
+	if err := checkRange(rb.Size, offset, r.Length()); err != nil {
+		return err
+	}
+	if len(rb.Pattern) == 0 {
+		if rb.Size != 0 {
+			return fmt.Errorf("can't repeat an empty pattern to fill %d bytes", rb.Size)
+		}
+		return nil
+	}
+
+	ofs := offset
+	for _, buf := range r {
+		for i := range buf {
+			buf[i] = rb.Pattern[ofs%len(rb.Pattern)]
+			ofs++
+		}
+	}
+	return nil
+}
+
+// A ConcatRegionBuilder builds a region from each of the given builders in
+// turn, with each one's content immediately following the previous one's.
+type ConcatRegionBuilder struct {
+	Builders []RegionBuilder
+}
+
+func (rb *ConcatRegionBuilder) Length() int {
+	length := 0
+	for _, builder := range rb.Builders {
+		length += builder.Length()
+	}
+	return length
+}
+
+func (rb *ConcatRegionBuilder) Build(r Region) error {
+	if err := r.Check(0, rb.Length()); err != nil {
+		return err
+	}
+
+	ofs := 0
+	for _, builder := range rb.Builders {
+		length := builder.Length()
+		if err := builder.Build(r.Slice(ofs, length)); err != nil {
+			return err
+		}
+		ofs += length
+	}
+	return nil
+}
+
+func (rb *ConcatRegionBuilder) PrepareRanges() (RangeBuilder, error) {
+	parts := make(RangeParts, 0, len(rb.Builders))
+	ofs := 0
+	for _, builder := range rb.Builders {
+		ranges, err := PrepareRanges(builder)
+		if err != nil {
+			parts.Close()
+			return nil, err
+		}
+		length := builder.Length()
+		parts = append(parts, RangePart{Offset: ofs, Length: length, Builder: ranges})
+		ofs += length
+	}
+	return parts, nil
+}
+
+// An AlignRegionBuilder builds a region from another builder, followed by
+// enough zero bytes to make its length a multiple of the given boundary.
+//
+// When used in a ConcatRegionBuilder, this causes whatever follows to begin
+// at an aligned offset, as long as everything before it is also aligned.
+type AlignRegionBuilder struct {
+	Builder  RegionBuilder
+	Boundary int
+}
+
+func (rb *AlignRegionBuilder) Length() int {
+	length := rb.Builder.Length()
+	if rb.Boundary <= 1 {
+		return length
+	}
+	return (length + rb.Boundary - 1) / rb.Boundary * rb.Boundary
+}
+
+func (rb *AlignRegionBuilder) Build(r Region) error {
+	length := rb.Length()
+	if err := r.Check(0, length); err != nil {
+		return err
+	}
+
+	contentLen := rb.Builder.Length()
+	if err := rb.Builder.Build(r.Slice(0, contentLen)); err != nil {
+		return err
+	}
+	zeroRegion(r.Slice(contentLen, length-contentLen))
+	return nil
+}
+
+func (rb *AlignRegionBuilder) PrepareRanges() (RangeBuilder, error) {
+	ranges, err := PrepareRanges(rb.Builder)
+	if err != nil {
+		return nil, err
+	}
+	return RangeParts{
+		{Offset: 0, Length: rb.Builder.Length(), Builder: ranges},
+	}, nil
+}
+
+// A Placement is a builder to be placed at a particular offset by a
+// PlacedRegionBuilder.
+type Placement struct {
+	Offset  int
+	Builder RegionBuilder
+}
+
+// A PlacedRegionBuilder builds a region from builders placed at fixed
+// offsets, filling any gaps between them with zero bytes.
+//
+// The region is at least Size bytes long, but is extended if necessary to
+// include the end of every placement. The placements may be given in any
+// order, but must not overlap.
+type PlacedRegionBuilder struct {
+	Placements []Placement
+	Size       int
+}
+
+func (rb *PlacedRegionBuilder) Length() int {
+	length := rb.Size
+	for _, p := range rb.Placements {
+		if end := p.Offset + p.Builder.Length(); end > length {
+			length = end
+		}
+	}
+	return length
+}
+
+func (rb *PlacedRegionBuilder) Build(r Region) error {
+	length := rb.Length()
+	if err := r.Check(0, length); err != nil {
+		return err
+	}
+
+	placements, err := rb.sortedPlacements()
+	if err != nil {
+		return err
+	}
+
+	ofs := 0
+	for _, p := range placements {
+		zeroRegion(r.Slice(ofs, p.Offset-ofs))
+
+		placedLen := p.Builder.Length()
+		if err := p.Builder.Build(r.Slice(p.Offset, placedLen)); err != nil {
+			return err
+		}
+		ofs = p.Offset + placedLen
+	}
+	zeroRegion(r.Slice(ofs, length-ofs))
+	return nil
+}
+
+func (rb *PlacedRegionBuilder) PrepareRanges() (RangeBuilder, error) {
+	placements, err := rb.sortedPlacements()
+	if err != nil {
+		return nil, err
+	}
+
+	parts := make(RangeParts, 0, len(placements))
+	for _, p := range placements {
+		ranges, err := PrepareRanges(p.Builder)
+		if err != nil {
+			parts.Close()
+			return nil, err
+		}
+		parts = append(parts, RangePart{Offset: p.Offset, Length: p.Builder.Length(), Builder: ranges})
+	}
+	return parts, nil
+}
+
+// sortedPlacements returns the placements in order of offset, or an error
+// if any of them overlap.
+func (rb *PlacedRegionBuilder) sortedPlacements() ([]Placement, error) {
+	placements := make([]Placement, len(rb.Placements))
+	copy(placements, rb.Placements)
+	sort.SliceStable(placements, func(i, j int) bool {
+		return placements[i].Offset < placements[j].Offset
+	})
+
+	ofs := 0
+	for _, p := range placements {
+		if p.Offset < ofs {
+			return nil, fmt.Errorf("placement at offset %d overlaps the content before it", p.Offset)
+		}
+		ofs = p.Offset + p.Builder.Length()
+	}
+	return placements, nil
+}
+
+// A ReaderAtRegionBuilder builds a region from Size bytes of an
+// io.ReaderAt, starting at the given Offset. The content is read directly
+// into the region when it is built, rather than being held in memory.
+type ReaderAtRegionBuilder struct {
+	Reader io.ReaderAt
+	Offset int64
+	Size   int
+}
+
+// RegionBuilderForFile returns a builder for the entire current content of
+// the given file. The file must remain open, and must not be truncated,
+// until the builder has been built.
+func RegionBuilderForFile(f *os.File) (*ReaderAtRegionBuilder, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &ReaderAtRegionBuilder{
+		Reader: f,
+		Size:   int(info.Size()),
+	}, nil
+}
+
+func (rb *ReaderAtRegionBuilder) Length() int {
+	return rb.Size
+}
+
+func (rb *ReaderAtRegionBuilder) Build(r Region) error {
+	if err := r.Check(0, rb.Size); err != nil {
+		return err
+	}
+	return rb.BuildRange(r.Slice(0, rb.Size), 0)
+}
+
+func (rb *ReaderAtRegionBuilder) PrepareRanges() (RangeBuilder, error) {
+	return rb, nil
+}
+
+func (rb *ReaderAtRegionBuilder) BuildRange(r Region, offset int) error {
+	if err := checkRange(rb.Size, offset, r.Length()); err != nil {
+		return err
+	}
+
+	ofs := rb.Offset + int64(offset)
+	for _, buf := range r {
+		n, err := rb.Reader.ReadAt(buf, ofs)
+		ofs += int64(n)
+		if n == len(buf) {
+			// ReaderAt may return io.EOF along with the final bytes.
+			continue
+		}
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return nil
 }
@@ -0,0 +1,144 @@
+package fsutil
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRegionBuilders(t *testing.T) {
+	type test struct {
+		builder  RegionBuilder
+		expected string
+	}
+
+	tests := []test{
+		{
+			&ZeroRegionBuilder{Size: 3},
+			"\x00\x00\x00",
+		},
+		{
+			&RepeatRegionBuilder{Pattern: []byte("abc"), Size: 7},
+			"abcabca",
+		},
+		{
+			&ConcatRegionBuilder{
+				Builders: []RegionBuilder{
+					&BufferRegionBuilder{Buffer: []byte("foo")},
+					&ZeroRegionBuilder{Size: 1},
+					&BufferRegionBuilder{Buffer: []byte("bar")},
+				},
+			},
+			"foo\x00bar",
+		},
+		{
+			&ConcatRegionBuilder{
+				Builders: []RegionBuilder{
+					&AlignRegionBuilder{
+						Builder:  &BufferRegionBuilder{Buffer: []byte("hello")},
+						Boundary: 4,
+					},
+					&AlignRegionBuilder{
+						Builder:  &BufferRegionBuilder{Buffer: []byte("four")},
+						Boundary: 4,
+					},
+				},
+			},
+			"hello\x00\x00\x00four",
+		},
+		{
+			&PlacedRegionBuilder{
+				Placements: []Placement{
+					{Offset: 6, Builder: &BufferRegionBuilder{Buffer: []byte("end")}},
+					{Offset: 1, Builder: &BufferRegionBuilder{Buffer: []byte("start")}},
+				},
+				Size: 10,
+			},
+			"\x00startend\x00",
+		},
+		{
+			&ReaderAtRegionBuilder{
+				Reader: strings.NewReader("Hello, world!"),
+				Offset: 7,
+				Size:   5,
+			},
+			"world",
+		},
+	}
+
+	for _, test := range tests {
+		if got, want := test.builder.Length(), len(test.expected); got != want {
+			t.Errorf("%#v has length %d; want %d", test.builder, got, want)
+			continue
+		}
+
+		// We build into a fragmented region filled with non-zero bytes,
+		// to check that builders don't depend on either being absent.
+		reg := Region{
+			[]byte(strings.Repeat("?", 2)),
+			[]byte(strings.Repeat("?", len(test.expected))),
+		}.Slice(0, len(test.expected))
+		if err := test.builder.Build(reg); err != nil {
+			t.Errorf("failed to build %#v: %s", test.builder, err)
+			continue
+		}
+		if got := string(reg.Bytes()); got != test.expected {
+			t.Errorf("%#v builds %q; want %q", test.builder, got, test.expected)
+		}
+	}
+}
+
+func TestRegionBuilderErrors(t *testing.T) {
+	tests := []RegionBuilder{
+		&PlacedRegionBuilder{
+			Placements: []Placement{
+				{Offset: 0, Builder: &ZeroRegionBuilder{Size: 4}},
+				{Offset: 2, Builder: &ZeroRegionBuilder{Size: 4}},
+			},
+		},
+		&ReaderAtRegionBuilder{
+			Reader: strings.NewReader("short"),
+			Size:   10,
+		},
+		&RepeatRegionBuilder{Size: 1},
+	}
+
+	for _, builder := range tests {
+		reg := RegionForBytes(make([]byte, builder.Length()))
+		if err := builder.Build(reg); err == nil {
+			t.Errorf("succeeded in building %#v; want error", builder)
+		}
+	}
+
+	err := (&ZeroRegionBuilder{Size: 4}).Build(RegionForBytes(make([]byte, 2)))
+	want := &OutOfBoundsError{Offset: 0, Length: 4, RegionLength: 2}
+	if !reflect.DeepEqual(err, want) {
+		t.Errorf("error is %#v; want %#v", err, want)
+	}
+}
+
+func TestRegionBuilderForFile(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "in.bin")
+	if err := os.WriteFile(fn, []byte("file content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	builder, err := RegionBuilderForFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := RegionForBytes(make([]byte, builder.Length()))
+	if err := builder.Build(reg); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(reg.Bytes()), "file content"; got != want {
+		t.Errorf("Result is %q; want %q", got, want)
+	}
+}
@@ -0,0 +1,114 @@
+package fsutil
+
+import (
+	"fmt"
+	"io"
+)
+
+var (
+	_ io.ReaderAt = Region(nil)
+	_ io.WriterAt = Region(nil)
+
+	_ io.ReadWriteSeeker = (*RegionCursor)(nil)
+	_ io.ReaderAt        = (*RegionCursor)(nil)
+	_ io.WriterAt        = (*RegionCursor)(nil)
+)
+
+// ReadAt implements io.ReaderAt, copying bytes from the region starting at
+// the given offset. If fewer than len(p) bytes remain in the region after
+// the offset, it reads those that remain and returns io.EOF.
+func (r Region) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, &OutOfBoundsError{
+			Offset:       int(off),
+			Length:       len(p),
+			RegionLength: r.Length(),
+		}
+	}
+
+	n := 0
+	if i, ofs, ok := r.locate(int(off)); ok {
+		n = copyOut(r, i, ofs, p)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt implements io.WriterAt, copying bytes into the region starting at
+// the given offset. A region cannot grow, so if the bytes extend beyond the
+// end of the region it writes those that fit and returns an
+// *OutOfBoundsError.
+func (r Region) WriteAt(p []byte, off int64) (int, error) {
+	if err := r.Check(int(off), len(p)); err != nil {
+		n := 0
+		if off >= 0 {
+			n = r.WriteBytes(int(off), p)
+		}
+		return n, err
+	}
+	return r.WriteBytes(int(off), p), nil
+}
+
+// RegionCursor reads from and writes to a region sequentially, tracking
+// the current position as an *os.File would. It implements
+// io.ReadWriteSeeker, and also io.ReaderAt and io.WriterAt, which ignore
+// the current position.
+type RegionCursor struct {
+	region Region
+	offset int64
+}
+
+// Cursor returns a new RegionCursor positioned at the start of the region.
+func (r Region) Cursor() *RegionCursor {
+	return &RegionCursor{region: r}
+}
+
+// Region returns the region that the cursor reads from and writes to.
+func (c *RegionCursor) Region() Region {
+	return c.region
+}
+
+func (c *RegionCursor) Read(p []byte) (int, error) {
+	if c.offset >= int64(c.region.Length()) {
+		return 0, io.EOF
+	}
+	n, _ := c.region.ReadAt(p, c.offset)
+	c.offset += int64(n)
+	return n, nil
+}
+
+func (c *RegionCursor) Write(p []byte) (int, error) {
+	n, err := c.region.WriteAt(p, c.offset)
+	c.offset += int64(n)
+	return n, err
+}
+
+func (c *RegionCursor) ReadAt(p []byte, off int64) (int, error) {
+	return c.region.ReadAt(p, off)
+}
+
+func (c *RegionCursor) WriteAt(p []byte, off int64) (int, error) {
+	return c.region.WriteAt(p, off)
+}
+
+// Seek sets the position for the next Read or Write. Seeking beyond the end
+// of the region is allowed, but subsequent reads will return io.EOF and
+// writes will fail, since a region cannot grow.
+func (c *RegionCursor) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += c.offset
+	case io.SeekEnd:
+		offset += int64(c.region.Length())
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("cannot seek to negative offset %d", offset)
+	}
+	c.offset = offset
+	return offset, nil
+}
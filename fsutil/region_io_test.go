@@ -0,0 +1,100 @@
+package fsutil
+
+import (
+	"io"
+	"reflect"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReadAt(t *testing.T) {
+	reg := Region([][]byte{
+		[]byte("Hel"),
+		[]byte(""),
+		[]byte("lo, w"),
+		[]byte("orld"),
+	})
+
+	type test struct {
+		offset   int64
+		length   int
+		expected string
+		err      error
+	}
+
+	tests := []test{
+		{0, 5, "Hello", nil},
+		{2, 6, "llo, w", nil},
+		{8, 4, "orld", nil},
+		{8, 6, "orld", io.EOF},
+		{12, 1, "", io.EOF},
+		{20, 1, "", io.EOF},
+	}
+
+	for _, test := range tests {
+		buf := make([]byte, test.length)
+		n, err := reg.ReadAt(buf, test.offset)
+		if got := string(buf[:n]); got != test.expected || err != test.err {
+			t.Errorf(
+				"ReadAt(%d, %d) gives %q, %#v; want %q, %#v",
+				test.offset, test.length, got, err, test.expected, test.err,
+			)
+		}
+	}
+}
+
+func TestWriteAt(t *testing.T) {
+	reg := Region([][]byte{
+		[]byte("...."),
+		[]byte("...."),
+	})
+
+	n, err := reg.WriteAt([]byte("1234"), 2)
+	if n != 4 || err != nil {
+		t.Errorf("in-range write gives %d, %#v; want 4, nil", n, err)
+	}
+
+	n, err = reg.WriteAt([]byte("5678"), 6)
+	want := &OutOfBoundsError{Offset: 6, Length: 4, RegionLength: 8}
+	if n != 2 || !reflect.DeepEqual(err, want) {
+		t.Errorf("short write gives %d, %#v; want 2, %#v", n, err, want)
+	}
+
+	expect := Region([][]byte{
+		[]byte("..12"),
+		[]byte("3456"),
+	})
+	if !reflect.DeepEqual(reg, expect) {
+		t.Errorf("Result is %#v; want %#v", reg, expect)
+	}
+}
+
+func TestCursor(t *testing.T) {
+	reg := Region([][]byte{
+		[]byte("Hello, "),
+		[]byte("wor"),
+		[]byte("ld!"),
+	})
+
+	err := iotest.TestReader(reg.Cursor(), []byte("Hello, world!"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	c := reg.Cursor()
+	if _, err := c.Seek(-6, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write([]byte("There!")); err != nil {
+		t.Errorf("failed to write: %s", err)
+	}
+	if got, want := string(reg.Bytes()), "Hello, There!"; got != want {
+		t.Errorf("Result is %q; want %q", got, want)
+	}
+	if n, err := c.Write([]byte("?")); n != 0 || err == nil {
+		t.Errorf("write at end gives %d, %#v; want 0 and an error", n, err)
+	}
+	if _, err := c.Seek(-1, io.SeekStart); err == nil {
+		t.Errorf("seek to negative offset succeeded; want error")
+	}
+}
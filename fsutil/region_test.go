@@ -103,6 +103,16 @@ func TestBytes(t *testing.T) {
 			}),
 			[]byte("HelloPizzaWorld"),
 		},
+		{
+			Region([][]byte{
+				[]byte("He"),
+				[]byte("llo"),
+				[]byte("Piz"),
+				[]byte("zaW"),
+				[]byte("orld"),
+			}),
+			[]byte("HelloPizzaWorld"),
+		},
 	}
 
 	for _, test := range tests {
@@ -113,6 +123,11 @@ func TestBytes(t *testing.T) {
 				test.r, got, test.expected,
 			)
 		}
+		// When the inner buffers are all the same length, the initial
+		// guess at the length is exact.
+		if cap(got) != len(got) {
+			t.Errorf("Bytes in %#v has capacity %d; want %d", test.r, cap(got), len(got))
+		}
 	}
 }
 
@@ -435,3 +450,31 @@ func TestReadU32BE(t *testing.T) {
 		)
 	}
 }
+
+func TestOutOfBounds(t *testing.T) {
+	reg := Region([][]byte{
+		[]byte{0x00, 0x00, 0x00, 0x00},
+		[]byte{0x00, 0x00},
+	})
+
+	_, err := reg.Checked().ReadU32LE(4)
+	want := &OutOfBoundsError{Offset: 4, Length: 4, RegionLength: 6}
+	if !reflect.DeepEqual(err, want) {
+		t.Errorf("error is %#v; want %#v", err, want)
+	}
+
+	if err := reg.Checked().WriteU16LE(4, 0xbeef); err != nil {
+		t.Errorf("failed to write in-range value: %s", err)
+	}
+	if got := reg.ReadU16LE(4); got != 0xbeef {
+		t.Errorf("Result is %04x; want beef", got)
+	}
+
+	defer func() {
+		got := recover()
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("panic value is %#v; want %#v", got, want)
+		}
+	}()
+	reg.ReadU32LE(4)
+}
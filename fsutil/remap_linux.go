@@ -0,0 +1,26 @@
+package fsutil
+
+import (
+	"os"
+
+	"github.com/edsrzf/mmap-go"
+	"golang.org/x/sys/unix"
+)
+
+// remap changes the size of the given mapping of the given file, which
+// has already been extended if the mapping is growing, returning the new
+// mapping. The old mapping must not be used afterwards unless remap fails,
+// in which case it is unchanged and still valid.
+func remap(m mmap.MMap, f *os.File, prot Protection, size int) (mmap.MMap, error) {
+	buf, err := unix.Mremap([]byte(m), size, unix.MREMAP_MAYMOVE)
+	if err == nil {
+		return mmap.MMap(buf), nil
+	}
+
+	// Some kernels don't support mremap at all, in which case the old
+	// mapping is unchanged and we can fall back on mapping again.
+	if err == unix.ENOSYS {
+		return remapByMapping(m, f, prot, size)
+	}
+	return nil, err
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package fsutil
+
+import (
+	"os"
+
+	"github.com/edsrzf/mmap-go"
+)
+
+// remap replaces the given mapping of the given file with one of the given
+// size by mapping the file again, since there is no portable way to resize
+// a mapping. As on Linux, the old mapping must not be used afterwards
+// unless remap fails.
+func remap(m mmap.MMap, f *os.File, prot Protection, size int) (mmap.MMap, error) {
+	return remapByMapping(m, f, prot, size)
+}
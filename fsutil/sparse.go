@@ -0,0 +1,154 @@
+package fsutil
+
+import (
+	"os"
+	"sort"
+)
+
+// A ByteRange describes Length bytes of a region's content, beginning at
+// Offset.
+type ByteRange struct {
+	Offset int
+	Length int
+}
+
+// A SparseRegionBuilder is a RegionBuilder that can report which parts of
+// its content are entirely zero, so that BuildFile can leave holes in the
+// file for them rather than writing them out.
+//
+// Reporting a range is only an optimization, so a builder may leave out
+// zero ranges that would be inconvenient to find, but it must never report
+// a range that contains non-zero bytes.
+type SparseRegionBuilder interface {
+	RegionBuilder
+	ZeroRanges() []ByteRange
+}
+
+// ZeroRanges returns the parts of the given builder's content that are
+// entirely zero, in order of offset and without overlaps, or nil if the
+// builder is not a SparseRegionBuilder.
+func ZeroRanges(builder RegionBuilder) []ByteRange {
+	sb, ok := builder.(SparseRegionBuilder)
+	if !ok {
+		return nil
+	}
+	return normalizeRanges(sb.ZeroRanges())
+}
+
+// normalizeRanges sorts the given ranges and merges any that overlap or
+// are adjacent, discarding any that are empty.
+func normalizeRanges(ranges []ByteRange) []ByteRange {
+	sorted := make([]ByteRange, 0, len(ranges))
+	for _, r := range ranges {
+		if r.Length > 0 {
+			sorted = append(sorted, r)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Offset < sorted[j].Offset
+	})
+
+	var ret []ByteRange
+	for _, r := range sorted {
+		if n := len(ret); n > 0 && r.Offset <= ret[n-1].Offset+ret[n-1].Length {
+			last := &ret[n-1]
+			if end := r.Offset + r.Length; end > last.Offset+last.Length {
+				last.Length = end - last.Offset
+			}
+			continue
+		}
+		ret = append(ret, r)
+	}
+	return ret
+}
+
+// appendOffsetRanges appends the zero ranges of the given builder to
+// ranges, with their offsets moved by the given amount.
+func appendOffsetRanges(ranges []ByteRange, builder RegionBuilder, offset int) []ByteRange {
+	for _, r := range ZeroRanges(builder) {
+		ranges = append(ranges, ByteRange{Offset: r.Offset + offset, Length: r.Length})
+	}
+	return ranges
+}
+
+func (rb *ZeroRegionBuilder) ZeroRanges() []ByteRange {
+	return []ByteRange{{Offset: 0, Length: rb.Size}}
+}
+
+func (rb *ConcatRegionBuilder) ZeroRanges() []ByteRange {
+	var ranges []ByteRange
+	ofs := 0
+	for _, builder := range rb.Builders {
+		ranges = appendOffsetRanges(ranges, builder, ofs)
+		ofs += builder.Length()
+	}
+	return ranges
+}
+
+func (rb *AlignRegionBuilder) ZeroRanges() []ByteRange {
+	contentLen := rb.Builder.Length()
+	ranges := appendOffsetRanges(nil, rb.Builder, 0)
+	return append(ranges, ByteRange{Offset: contentLen, Length: rb.Length() - contentLen})
+}
+
+func (rb *PlacedRegionBuilder) ZeroRanges() []ByteRange {
+	placements, err := rb.sortedPlacements()
+	if err != nil {
+		// Build will report this problem.
+		return nil
+	}
+
+	var ranges []ByteRange
+	ofs := 0
+	for _, p := range placements {
+		ranges = append(ranges, ByteRange{Offset: ofs, Length: p.Offset - ofs})
+		ranges = appendOffsetRanges(ranges, p.Builder, p.Offset)
+		ofs = p.Offset + p.Builder.Length()
+	}
+	return append(ranges, ByteRange{Offset: ofs, Length: rb.Length() - ofs})
+}
+
+// buildSparseFile builds the given builder into the given file, which must
+// already be of the builder's length and contain only zero bytes, writing
+// only the parts of the content outside of the given zero ranges.
+func buildSparseFile(f *os.File, builder RegionBuilder, zeros []ByteRange) error {
+	rb, err := PrepareRanges(builder)
+	if err != nil {
+		return err
+	}
+
+	err = buildSparseRanges(f, rb, builder.Length(), zeros)
+	if closeErr := CloseRanges(rb); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func buildSparseRanges(f *os.File, rb RangeBuilder, length int, zeros []ByteRange) error {
+	window := make([]byte, buildWindowSize)
+	writeData := func(offset, end int) error {
+		for offset < end {
+			buf := window
+			if remain := end - offset; remain < len(buf) {
+				buf = buf[:remain]
+			}
+			if err := rb.BuildRange(RegionForBytes(buf), offset); err != nil {
+				return err
+			}
+			if _, err := f.WriteAt(buf, int64(offset)); err != nil {
+				return err
+			}
+			offset += len(buf)
+		}
+		return nil
+	}
+
+	ofs := 0
+	for _, zero := range zeros {
+		if err := writeData(ofs, zero.Offset); err != nil {
+			return err
+		}
+		ofs = zero.Offset + zero.Length
+	}
+	return writeData(ofs, length)
+}
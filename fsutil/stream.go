@@ -0,0 +1,226 @@
+package fsutil
+
+import (
+	"io"
+	"sort"
+)
+
+// buildWindowSize is the size of the buffer that BuildTo builds into
+// before writing to its writer.
+const buildWindowSize = 1 << 20
+
+// A RangeBuilder builds arbitrary parts of the content of a region.
+//
+// A RangeBuilder that holds resources between ranges, such as an open
+// file, may also implement io.Closer so that they can be released once no
+// more ranges are needed. See CloseRanges.
+type RangeBuilder interface {
+	// BuildRange builds r.Length() bytes of content into r, beginning with
+	// the byte at the given offset into the content.
+	BuildRange(r Region, offset int) error
+}
+
+// A RangeRegionBuilder is a RegionBuilder that can also build its content
+// in separate parts, which allows it to be written out sequentially through
+// a small window rather than needing memory for the entire region at once.
+//
+// Most RegionBuilders have nothing to prepare, and so PrepareRanges can
+// return the builder itself, but some may need to do work up front, such as
+// deciding on a layout, that would be wasteful to repeat for each range.
+type RangeRegionBuilder interface {
+	RegionBuilder
+	PrepareRanges() (RangeBuilder, error)
+}
+
+// PrepareRanges returns a RangeBuilder for the given builder.
+//
+// If the builder is not a RangeRegionBuilder then its content is built in
+// full, in memory, the first time a range is requested, and then retained
+// until its final byte has been requested.
+//
+// The caller must pass the result to CloseRanges once it has finished
+// building ranges, whether or not building succeeded.
+func PrepareRanges(builder RegionBuilder) (RangeBuilder, error) {
+	if rb, ok := builder.(RangeRegionBuilder); ok {
+		return rb.PrepareRanges()
+	}
+	return &bufferedRangeBuilder{builder: builder}, nil
+}
+
+// CloseRanges releases any resources held by the given RangeBuilder, by
+// calling its Close method if it implements io.Closer.
+func CloseRanges(rb RangeBuilder) error {
+	if c, ok := rb.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// bufferedRangeBuilder adapts a RegionBuilder that can only build its
+// content all at once, which may be done in any order.
+type bufferedRangeBuilder struct {
+	builder RegionBuilder
+	buf     []byte
+}
+
+func (rb *bufferedRangeBuilder) BuildRange(r Region, offset int) error {
+	if rb.buf == nil {
+		buf := make([]byte, rb.builder.Length())
+		if err := rb.builder.Build(RegionForBytes(buf)); err != nil {
+			return err
+		}
+		rb.buf = buf
+	}
+
+	length := r.Length()
+	if err := checkRange(len(rb.buf), offset, length); err != nil {
+		return err
+	}
+	r.WriteBytes(0, rb.buf[offset:offset+length])
+
+	if offset+length == len(rb.buf) {
+		// We're usually used sequentially, so this is probably the last
+		// we'll see of the content. If not, we'll just build it again.
+		rb.buf = nil
+	}
+	return nil
+}
+
+// BuildTo builds the given builder and writes its content to w, returning
+// the number of bytes written. This allows building into destinations that
+// can't be mapped into memory, such as pipes and network connections.
+//
+// The content is built through a window that moves sequentially over the
+// region, so memory is needed only for the window and for whatever the
+// builder needs in order to prepare its ranges. See PrepareRanges.
+func BuildTo(w io.Writer, builder RegionBuilder) (int64, error) {
+	rb, err := PrepareRanges(builder)
+	if err != nil {
+		return 0, err
+	}
+
+	written, err := buildRangesTo(w, rb, builder.Length())
+	if closeErr := CloseRanges(rb); err == nil {
+		err = closeErr
+	}
+	return written, err
+}
+
+func buildRangesTo(w io.Writer, rb RangeBuilder, length int) (int64, error) {
+	windowSize := buildWindowSize
+	if length < windowSize {
+		windowSize = length
+	}
+	window := make([]byte, windowSize)
+
+	written := int64(0)
+	for offset := 0; offset < length; offset += windowSize {
+		buf := window
+		if remain := length - offset; remain < len(buf) {
+			buf = buf[:remain]
+		}
+		if err := rb.BuildRange(RegionForBytes(buf), offset); err != nil {
+			return written, err
+		}
+		n, err := w.Write(buf)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// checkRange returns an *OutOfBoundsError if the given range is not
+// entirely within content of the given length.
+func checkRange(contentLength, offset, length int) error {
+	if offset < 0 || length < 0 || offset > contentLength || length > contentLength-offset {
+		return &OutOfBoundsError{
+			Offset:       offset,
+			Length:       length,
+			RegionLength: contentLength,
+		}
+	}
+	return nil
+}
+
+// rangeSpan describes where a range and a part of a region's content
+// overlap, as offsets into the range and into the part.
+type rangeSpan struct {
+	rangeOffset int
+	partOffset  int
+	length      int
+}
+
+// overlap finds where the range of the given length, starting at the
+// given offset, overlaps a part that starts at partStart and has the given
+// length. ok is false if they don't overlap at all.
+func overlap(offset, length, partStart, partLength int) (span rangeSpan, ok bool) {
+	start := offset
+	if partStart > start {
+		start = partStart
+	}
+	end := offset + length
+	if partEnd := partStart + partLength; partEnd < end {
+		end = partEnd
+	}
+	if start >= end {
+		return rangeSpan{}, false
+	}
+	return rangeSpan{
+		rangeOffset: start - offset,
+		partOffset:  start - partStart,
+		length:      end - start,
+	}, true
+}
+
+// RangePart is a part of the content of a RangeParts, which is built by the
+// given RangeBuilder.
+type RangePart struct {
+	Offset  int
+	Length  int
+	Builder RangeBuilder
+}
+
+// RangeParts is a RangeBuilder made from parts that are each built by
+// their own RangeBuilder. Any bytes not covered by a part are zero.
+//
+// The parts must be in order of offset and must not overlap.
+type RangeParts []RangePart
+
+func (p RangeParts) BuildRange(r Region, offset int) error {
+	length := r.Length()
+
+	// Skip over any parts that end before our range begins.
+	first := sort.Search(len(p), func(i int) bool {
+		return p[i].Offset+p[i].Length > offset
+	})
+
+	ofs := 0
+	for _, part := range p[first:] {
+		span, ok := overlap(offset, length, part.Offset, part.Length)
+		if !ok {
+			break
+		}
+		zeroRegion(r.Slice(ofs, span.rangeOffset-ofs))
+		err := part.Builder.BuildRange(r.Slice(span.rangeOffset, span.length), span.partOffset)
+		if err != nil {
+			return err
+		}
+		ofs = span.rangeOffset + span.length
+	}
+	zeroRegion(r.Slice(ofs, length-ofs))
+	return nil
+}
+
+// Close closes the builders of all of the parts, returning the first error
+// encountered.
+func (p RangeParts) Close() error {
+	var ret error
+	for _, part := range p {
+		if err := CloseRanges(part.Builder); err != nil && ret == nil {
+			ret = err
+		}
+	}
+	return ret
+}
@@ -0,0 +1,99 @@
+package fsutil
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// backwardsRegionBuilder writes its content from the end to the start, and
+// so can only be built all at once.
+type backwardsRegionBuilder struct {
+	content []byte
+}
+
+func (rb *backwardsRegionBuilder) Length() int {
+	return len(rb.content)
+}
+
+func (rb *backwardsRegionBuilder) Build(r Region) error {
+	for i := len(rb.content) - 1; i >= 0; i-- {
+		r.WriteU8(i, rb.content[i])
+	}
+	return nil
+}
+
+func TestBuildTo(t *testing.T) {
+	// Large enough to need several windows, with parts that span the
+	// boundaries between them.
+	big := bytes.Repeat([]byte("0123456789"), buildWindowSize/4)
+
+	tests := []RegionBuilder{
+		&ZeroRegionBuilder{Size: 0},
+		&BufferRegionBuilder{Buffer: []byte("hello")},
+		&RepeatRegionBuilder{Pattern: []byte("abc"), Size: buildWindowSize + 7},
+		&ConcatRegionBuilder{
+			Builders: []RegionBuilder{
+				&backwardsRegionBuilder{content: big},
+				&AlignRegionBuilder{
+					Builder:  &BufferRegionBuilder{Buffer: []byte("middle")},
+					Boundary: 4096,
+				},
+				&ReaderAtRegionBuilder{
+					Reader: bytes.NewReader(big),
+					Offset: 3,
+					Size:   len(big) - 3,
+				},
+			},
+		},
+		&PlacedRegionBuilder{
+			Placements: []Placement{
+				{Offset: buildWindowSize - 2, Builder: &BufferRegionBuilder{Buffer: []byte("span")}},
+				{Offset: 1, Builder: &backwardsRegionBuilder{content: []byte("start")}},
+			},
+			Size: buildWindowSize * 2,
+		},
+	}
+
+	for _, builder := range tests {
+		want := make([]byte, builder.Length())
+		if err := builder.Build(RegionForBytes(want)); err != nil {
+			t.Fatalf("failed to build %T: %s", builder, err)
+		}
+
+		var buf bytes.Buffer
+		n, err := BuildTo(&buf, builder)
+		if err != nil {
+			t.Errorf("failed to stream %T: %s", builder, err)
+			continue
+		}
+		if n != int64(len(want)) {
+			t.Errorf("%T wrote %d bytes; want %d", builder, n, len(want))
+		}
+		if !bytes.Equal(buf.Bytes(), want) {
+			t.Errorf("%T streamed different content than it builds", builder)
+		}
+	}
+}
+
+func TestRangeParts(t *testing.T) {
+	parts := RangeParts{
+		{Offset: 2, Length: 3, Builder: &BufferRegionBuilder{Buffer: []byte("abc")}},
+		{Offset: 5, Length: 2, Builder: &BufferRegionBuilder{Buffer: []byte("de")}},
+		{Offset: 9, Length: 1, Builder: &BufferRegionBuilder{Buffer: []byte("f")}},
+	}
+	content := "\x00\x00abcde\x00\x00f\x00"
+
+	for offset := 0; offset <= len(content); offset++ {
+		for length := 0; offset+length <= len(content); length++ {
+			reg := RegionForBytes([]byte(strings.Repeat("?", length)))
+			if err := parts.BuildRange(reg, offset); err != nil {
+				t.Errorf("failed to build %d bytes at %d: %s", length, offset, err)
+				continue
+			}
+			if got, want := string(reg.Bytes()), content[offset:offset+length]; got != want {
+				t.Errorf("%d bytes at %d are %q; want %q", length, offset, got, want)
+			}
+		}
+	}
+}
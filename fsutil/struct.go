@@ -0,0 +1,318 @@
+package fsutil
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ReadStruct and WriteStruct transfer the fields of a struct to and from a
+// region, in a similar manner to encoding/binary but with the layout
+// described by struct tags, so that on-disk structures can be declared once
+// and then used both for reading and for writing.
+//
+// Each field may have a tag of the form `region:"offset,options..."`. The
+// offset is relative to the start of the struct and may be written in any
+// form accepted by strconv.ParseInt, such as "0x1fe". If it is omitted,
+// the field immediately follows the one before it. The options are:
+//
+//	be      the field is big-endian, rather than the default little-endian
+//	le      the field is little-endian
+//	size=N  an integer field occupies N bytes, rather than its own size
+//
+// Fields may be booleans, integers, arrays of those types, byte arrays and
+// nested structs, whose own tags are relative to their starting offset.
+// Blank fields named "_" occupy space but are neither read nor written,
+// which can be used to skip over padding or reserved areas. Fields tagged
+// `region:"-"` and other unexported fields are ignored.
+
+// ReadStruct reads the fields of the struct that v points to from the
+// region, starting at the given address.
+func (r *Region) ReadStruct(addr int, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("ReadStruct requires a non-nil pointer to a struct, not %T", v)
+	}
+	rv = rv.Elem()
+
+	layout, err := structLayoutFor(rv.Type())
+	if err != nil {
+		return err
+	}
+	if err := r.Check(addr, layout.size); err != nil {
+		return err
+	}
+
+	for _, f := range layout.fields {
+		fv := f.value(rv)
+		ofs := addr + f.offset
+		switch f.kind {
+		case byteArrayField:
+			i, bufOfs := r.mustLocate(ofs, f.size)
+			copyOut(*r, i, bufOfs, fv.Slice(0, f.size).Bytes())
+		case boolField:
+			fv.SetBool(r.ReadU8(ofs) != 0)
+		case intField, uintField:
+			var val uint64
+			if f.bigEndian {
+				val = r.ReadBE(ofs, f.size)
+			} else {
+				val = r.ReadLE(ofs, f.size)
+			}
+			if f.kind == uintField {
+				fv.SetUint(val)
+			} else {
+				// Sign-extend from the field's own width.
+				shift := uint(64 - 8*f.size)
+				fv.SetInt(int64(val<<shift) >> shift)
+			}
+		}
+	}
+	return nil
+}
+
+// WriteStruct writes the fields of the given struct, or of the struct that
+// v points to, into the region starting at the given address. Bytes that
+// are not covered by any field are left unchanged.
+//
+// WriteStruct either writes all of the fields or returns an error without
+// writing any of them.
+func (r *Region) WriteStruct(addr int, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return fmt.Errorf("WriteStruct requires a struct or a pointer to a struct, not %T", v)
+	}
+	if !rv.CanAddr() {
+		// Byte arrays can only be sliced when they are addressable.
+		addressable := reflect.New(rv.Type()).Elem()
+		addressable.Set(rv)
+		rv = addressable
+	}
+
+	layout, err := structLayoutFor(rv.Type())
+	if err != nil {
+		return err
+	}
+	if err := r.Check(addr, layout.size); err != nil {
+		return err
+	}
+
+	for _, f := range layout.fields {
+		fv := f.value(rv)
+		ofs := addr + f.offset
+		var val uint64
+		switch f.kind {
+		case byteArrayField:
+			r.WriteBytes(ofs, fv.Slice(0, f.size).Bytes())
+			continue
+		case boolField:
+			if fv.Bool() {
+				val = 1
+			}
+		case intField:
+			val = uint64(fv.Int())
+		case uintField:
+			val = fv.Uint()
+		}
+		if f.bigEndian {
+			r.WriteBE(ofs, f.size, val)
+		} else {
+			r.WriteLE(ofs, f.size, val)
+		}
+	}
+	return nil
+}
+
+// StructSize returns the number of bytes that ReadStruct and WriteStruct
+// will access for the given struct, or for the struct v points to.
+func StructSize(v interface{}) (int, error) {
+	t := reflect.TypeOf(v)
+	if t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return 0, fmt.Errorf("StructSize requires a struct or a pointer to a struct, not %T", v)
+	}
+	layout, err := structLayoutFor(t)
+	if err != nil {
+		return 0, err
+	}
+	return layout.size, nil
+}
+
+type structFieldKind int
+
+const (
+	boolField structFieldKind = iota
+	intField
+	uintField
+	byteArrayField
+)
+
+// structField describes one value that ReadStruct and WriteStruct transfer,
+// found by following path from the outermost struct. Each element of path
+// is either a field index or, for arrays, an element index.
+type structField struct {
+	path      []int
+	offset    int
+	size      int
+	kind      structFieldKind
+	bigEndian bool
+}
+
+func (f *structField) value(v reflect.Value) reflect.Value {
+	for _, i := range f.path {
+		if v.Kind() == reflect.Struct {
+			v = v.Field(i)
+		} else {
+			v = v.Index(i)
+		}
+	}
+	return v
+}
+
+type structLayout struct {
+	fields []structField
+	size   int
+}
+
+// structLayouts caches the layout of each struct type, since they can be
+// used many times, such as once for each entry in a directory.
+var structLayouts sync.Map
+
+func structLayoutFor(t reflect.Type) (*structLayout, error) {
+	if cached, ok := structLayouts.Load(t); ok {
+		return cached.(*structLayout), nil
+	}
+
+	layout := &structLayout{}
+	size, err := layout.addStruct(t, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	layout.size = size
+
+	structLayouts.Store(t, layout)
+	return layout, nil
+}
+
+type structFieldOptions struct {
+	bigEndian bool
+	size      int
+}
+
+// addStruct adds the fields of the given struct type, starting at the given
+// offset, and returns the number of bytes they cover.
+func (l *structLayout) addStruct(t reflect.Type, base int, path []int) (int, error) {
+	next := 0
+	extent := 0
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("region")
+		blank := sf.Name == "_"
+		if tag == "-" || (sf.PkgPath != "" && !blank) {
+			continue
+		}
+
+		offset := next
+		var opts structFieldOptions
+		parts := strings.Split(tag, ",")
+		if parts[0] != "" {
+			ofs, err := strconv.ParseInt(parts[0], 0, 0)
+			if err != nil || ofs < 0 {
+				return 0, fmt.Errorf("field %s.%s has invalid offset %q", t, sf.Name, parts[0])
+			}
+			offset = int(ofs)
+		}
+		for _, opt := range parts[1:] {
+			switch {
+			case opt == "be":
+				opts.bigEndian = true
+			case opt == "le":
+				opts.bigEndian = false
+			case strings.HasPrefix(opt, "size="):
+				size, err := strconv.Atoi(opt[len("size="):])
+				if err != nil || size < 1 || size > 8 {
+					return 0, fmt.Errorf("field %s.%s has invalid option %q", t, sf.Name, opt)
+				}
+				opts.size = size
+			default:
+				return 0, fmt.Errorf("field %s.%s has unknown option %q", t, sf.Name, opt)
+			}
+		}
+
+		target := l
+		if blank {
+			// We still need the size of padding, but don't want to
+			// transfer its value.
+			target = &structLayout{}
+		}
+		fieldPath := append(append([]int(nil), path...), i)
+		size, err := target.addValue(sf.Type, base+offset, fieldPath, opts)
+		if err != nil {
+			return 0, fmt.Errorf("field %s.%s: %w", t, sf.Name, err)
+		}
+
+		next = offset + size
+		if next > extent {
+			extent = next
+		}
+	}
+	return extent, nil
+}
+
+// addValue adds a value of the given type at the given offset, and returns
+// the number of bytes it covers.
+func (l *structLayout) addValue(t reflect.Type, offset int, path []int, opts structFieldOptions) (int, error) {
+	field := structField{
+		path:      path,
+		offset:    offset,
+		size:      int(t.Size()),
+		bigEndian: opts.bigEndian,
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		field.kind = boolField
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		field.kind = intField
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		field.kind = uintField
+	case reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 && opts.size == 0 {
+			field.kind = byteArrayField
+			break
+		}
+		size := 0
+		for i := 0; i < t.Len(); i++ {
+			elemPath := append(append([]int(nil), path...), i)
+			elemSize, err := l.addValue(t.Elem(), offset+size, elemPath, opts)
+			if err != nil {
+				return 0, err
+			}
+			size += elemSize
+		}
+		return size, nil
+	case reflect.Struct:
+		if opts.size != 0 {
+			return 0, fmt.Errorf("size option is not valid for a struct")
+		}
+		return l.addStruct(t, offset, path)
+	default:
+		return 0, fmt.Errorf("unsupported type %s", t)
+	}
+
+	if opts.size != 0 {
+		if field.kind == boolField {
+			return 0, fmt.Errorf("size option is not valid for a bool")
+		}
+		field.size = opts.size
+	}
+	l.fields = append(l.fields, field)
+	return field.size, nil
+}
@@ -0,0 +1,91 @@
+package fsutil
+
+import (
+	"reflect"
+	"testing"
+)
+
+type testStructInner struct {
+	A uint16 `region:"0x00,be"`
+	B int8
+}
+
+type testStruct struct {
+	Magic  [4]byte         `region:"0x00"`
+	Count  uint32          `region:"0x04"`
+	Short  uint32          `region:"0x08,size=2"`
+	Signed int16           `region:",be"`
+	_      [2]byte         // Reserved
+	Flag   bool            `region:"0x0e"`
+	Inner  testStructInner `region:"0x10"`
+	Words  [2]uint16       `region:"0x13"`
+	Skip   string          `region:"-"`
+}
+
+func TestStructRoundTrip(t *testing.T) {
+	want := testStruct{
+		Magic:  [4]byte{'T', 'E', 'S', 'T'},
+		Count:  0xdeadbeef,
+		Short:  0x1234,
+		Signed: -2,
+		Flag:   true,
+		Inner:  testStructInner{A: 0xcafe, B: -5},
+		Words:  [2]uint16{0x0102, 0x0304},
+	}
+
+	if size, err := StructSize(want); err != nil || size != 0x17 {
+		t.Errorf("StructSize is %d, %v; want %d", size, err, 0x17)
+	}
+
+	reg := Region([][]byte{
+		make([]byte, 3),
+		make([]byte, 7),
+		make([]byte, 16),
+	})
+	for _, buf := range reg {
+		for i := range buf {
+			buf[i] = 0xaa
+		}
+	}
+	if err := reg.WriteStruct(1, &want); err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+
+	// Bytes outside of the fields, including the padding, are unchanged.
+	expect := []byte{
+		0xaa, 'T', 'E', 'S', 'T', 0xef, 0xbe, 0xad, 0xde, 0x34,
+		0x12, 0xff, 0xfe, 0xaa, 0xaa, 0x01, 0xaa, 0xca, 0xfe, 0xfb,
+		0x02, 0x01, 0x04, 0x03, 0xaa, 0xaa,
+	}
+	if got := reg.Bytes(); !reflect.DeepEqual(got, expect) {
+		t.Errorf("Result is % x; want % x", got, expect)
+	}
+
+	var got testStruct
+	if err := reg.ReadStruct(1, &got); err != nil {
+		t.Fatalf("failed to read: %s", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Result is %#v; want %#v", got, want)
+	}
+}
+
+func TestStructErrors(t *testing.T) {
+	reg := RegionForBytes(make([]byte, 0x10))
+	if err := reg.WriteStruct(0, testStruct{Count: 1}); err == nil {
+		t.Errorf("succeeded in writing beyond end of region; want error")
+	}
+	if got := reg.Bytes(); !reflect.DeepEqual(got, make([]byte, 0x10)) {
+		t.Errorf("failed write modified the region to % x", got)
+	}
+
+	var bad struct {
+		A uint16 `region:"0x00,size=9"`
+	}
+	if err := reg.ReadStruct(0, &bad); err == nil {
+		t.Errorf("succeeded with invalid size option; want error")
+	}
+	if err := reg.ReadStruct(0, testStruct{}); err == nil {
+		t.Errorf("succeeded in reading into a non-pointer; want error")
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !unix
+
+package fsutil
+
+import (
+	"os"
+)
+
+// FileUsage returns the apparent size of the named file, as reported by
+// its length, and the number of bytes of storage actually allocated for
+// it, which is smaller if the file is sparse.
+//
+// On this platform the allocated size is not known, so it is reported as
+// being the same as the apparent size.
+func FileUsage(fn string) (apparent, allocated int64, err error) {
+	info, err := os.Stat(fn)
+	if err != nil {
+		return 0, 0, err
+	}
+	return info.Size(), info.Size(), nil
+}
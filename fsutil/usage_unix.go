@@ -0,0 +1,24 @@
+//go:build unix
+
+package fsutil
+
+import (
+	"os"
+	"syscall"
+)
+
+// FileUsage returns the apparent size of the named file, as reported by
+// its length, and the number of bytes of storage actually allocated for
+// it, which is smaller if the file is sparse.
+func FileUsage(fn string) (apparent, allocated int64, err error) {
+	info, err := os.Stat(fn)
+	if err != nil {
+		return 0, 0, err
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		// Blocks is always counted in 512-byte units, regardless of the
+		// filesystem's own block size.
+		return info.Size(), int64(st.Blocks) * 512, nil
+	}
+	return info.Size(), info.Size(), nil
+}
@@ -1,69 +1,327 @@
+// Command make-vfat-fs builds a FAT filesystem image from the contents of a
+// directory, without needing root privileges or a loop device.
+//
+// Usage:
+//
+//	make-vfat-fs [flags] -o OUTPUT [SOURCE-DIR]
+//
+// The contents of SOURCE-DIR, if given, become the root directory of the
+// filesystem. A manifest given with -manifest can add further files and
+// directories, one per line in the form
+//
+//	TARGET SOURCE
+//
+// where TARGET is the path within the filesystem and SOURCE is a file or
+// directory on the host, relative to the manifest's own directory unless
+// it is absolute. A TARGET of "." refers to the root directory itself.
+// Either path may be written as a double-quoted Go string if it contains
+// spaces. Blank lines and lines beginning with "#" are ignored. Any
+// directories needed to hold the targets are created automatically.
 package main
 
-// Note well: for now this is just a scratch program used for testing. It
-// doesn't do anything useful and before it does its interface is likely
-// to change significantly.
-
 import (
+	"bufio"
 	"flag"
 	"fmt"
+	"io"
+	"math"
 	"os"
-	"time"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/apparentlymart/go-fsutil/fsutil"
 	"github.com/apparentlymart/go-fsutil/vfat"
 )
 
 func main() {
-	flag.Parse()
-
-	targetFn := flag.Arg(0)
-
-	err := run(targetFn)
+	err := run(os.Args[1:], os.Stderr)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "%s\n", err)
+		fmt.Fprintf(os.Stderr, "make-vfat-fs: %s\n", err)
 		os.Exit(2)
 	}
 }
 
-func run(targetFn string) error {
+func run(args []string, stderr io.Writer) error {
+	flags := flag.NewFlagSet("make-vfat-fs", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: make-vfat-fs [flags] -o OUTPUT [SOURCE-DIR]\n\n")
+		flags.PrintDefaults()
+	}
+
+	output := flags.String("o", "", "`path` of the image file to write (required)")
+	manifest := flags.String("manifest", "", "`path` of a manifest listing additional files and directories")
+	label := flags.String("label", "", "volume `label`, of at most 11 characters")
+	volumeID := flags.String("volume-id", "", "volume ID as 8 hex `digits`, such as 1234-ABCD (default derived from the content with -reproducible, or zero)")
+	size := flags.String("size", "", "exact image `size` in bytes, optionally with a K, M, G or T suffix (default just large enough for the content)")
+	clusterSize := flags.Uint("cluster-size", 0, "cluster size in `bytes` (default chosen automatically)")
+	fatType := flags.Uint("fat", 0, "FAT `type`: 12, 16 or 32 (default chosen automatically)")
+	extraClusters := flags.Uint("extra-clusters", 0, "number of free `clusters` to leave, when -size is not given")
+	reproducible := flags.Bool("reproducible", false, "produce identical images from identical content, with timestamps no later than SOURCE_DATE_EPOCH, or 1980-01-01 if it isn't set")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *output == "" || flags.NArg() > 1 {
+		flags.Usage()
+		return fmt.Errorf("an output path and at most one source directory are required")
+	}
+
 	fs := &vfat.Filesystem{
-		VolumeID:          0xdeadbeef,
-		Label:             [11]byte{
-			'T', 'E', 'S', 'T', ' ', ' ', ' ', ' ', ' ', ' ', ' ',
-		},
-		ExtraClusterCount: 20,
-
-		RootDir: &vfat.Directory{
-			Dirs: []vfat.DirEntryDir{
-				{
-					DirEntryCommon: vfat.DirEntryCommon{
-						Name:             "foobaz",
-						CreationTime:     time.Now(),
-						LastAccessedTime: time.Now(),
-						LastModifiedTime: time.Now(),
-					},
-					Directory: &vfat.Directory{
-						Dirs: []vfat.DirEntryDir{},
-						Files: []vfat.DirEntryFile{},
-					},
-				},
-			},
-			Files: []vfat.DirEntryFile{
-				{
-					DirEntryCommon: vfat.DirEntryCommon{
-						Name:             "hello.txt",
-						CreationTime:     time.Now(),
-						LastAccessedTime: time.Now(),
-						LastModifiedTime: time.Now(),
-					},
-					BodyBuilder: &fsutil.BufferRegionBuilder{
-						Buffer: []byte("Hello, world!"),
-					},
-				},
-			},
-		},
-	}
-
-	return fsutil.BuildFile(targetFn, fs)
+		ClusterSize:       uint32(*clusterSize),
+		FATType:           vfat.FATType(*fatType),
+		ExtraClusterCount: uint32(*extraClusters),
+		Reproducible:      *reproducible,
+	}
+	switch fs.FATType {
+	case vfat.AutoFATType, vfat.FAT12, vfat.FAT16, vfat.FAT32:
+	default:
+		return fmt.Errorf("FAT type must be 12, 16 or 32")
+	}
+
+	var err error
+	if fs.Label, err = vfat.MakeLabel(*label); err != nil {
+		return err
+	}
+	if *volumeID != "" {
+		if fs.VolumeID, err = parseVolumeID(*volumeID); err != nil {
+			return err
+		}
+	}
+	if *size != "" {
+		if fs.TotalSize, err = parseSize(*size); err != nil {
+			return err
+		}
+	}
+
+	fs.RootDir = &vfat.Directory{}
+	if flags.NArg() == 1 {
+		fs.RootDir, err = vfat.DirectoryFromFS(os.DirFS(flags.Arg(0)), ".")
+		if err != nil {
+			return err
+		}
+	}
+	if *manifest != "" {
+		if err := addManifest(fs.RootDir, *manifest); err != nil {
+			return err
+		}
+	}
+
+	return fsutil.BuildFile(*output, fs)
+}
+
+// parseVolumeID parses a volume ID written as eight hexadecimal digits,
+// optionally split into two groups of four by a hyphen as it is usually
+// displayed, or with a 0x prefix.
+func parseVolumeID(s string) (uint32, error) {
+	digits := strings.TrimPrefix(strings.ToLower(s), "0x")
+	if len(digits) == 9 && digits[4] == '-' {
+		digits = digits[:4] + digits[5:]
+	}
+	id, err := strconv.ParseUint(digits, 16, 32)
+	if err != nil || len(digits) != 8 {
+		return 0, fmt.Errorf("volume ID %q is not 8 hexadecimal digits", s)
+	}
+	return uint32(id), nil
+}
+
+// parseSize parses a size in bytes, optionally followed by a K, M, G or T
+// suffix that multiplies it by the corresponding power of 1024.
+func parseSize(s string) (uint64, error) {
+	digits := strings.ToUpper(s)
+	shift := 0
+	if i := strings.IndexAny(digits, "KMGT"); i >= 0 && i == len(digits)-1 {
+		shift = 10 * (1 + strings.IndexByte("KMGT", digits[i]))
+		digits = digits[:i]
+	}
+	n, err := strconv.ParseUint(digits, 10, 64)
+	if err != nil || n > math.MaxUint64>>shift || n == 0 {
+		return 0, fmt.Errorf("size %q is not a positive number of bytes, optionally with a K, M, G or T suffix", s)
+	}
+	return n << shift, nil
+}
+
+// addManifest adds the files and directories listed in the given manifest
+// file to the root directory.
+func addManifest(root *vfat.Directory, fn string) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	baseDir := filepath.Dir(fn)
+	sc := bufio.NewScanner(f)
+	for lineNum := 1; sc.Scan(); lineNum++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		target, source, err := parseManifestLine(line)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", fn, lineNum, err)
+		}
+		if !filepath.IsAbs(source) {
+			source = filepath.Join(baseDir, source)
+		}
+		if err := addEntry(root, target, source); err != nil {
+			return fmt.Errorf("%s:%d: %w", fn, lineNum, err)
+		}
+	}
+	return sc.Err()
+}
+
+// parseManifestLine splits a manifest line into its target and source,
+// each of which may be a double-quoted Go string.
+func parseManifestLine(line string) (target, source string, err error) {
+	var fields []string
+	for rest := line; rest != ""; rest = strings.TrimLeft(rest, " \t") {
+		field := rest
+		if rest[0] == '"' {
+			quoted, err := strconv.QuotedPrefix(rest)
+			if err != nil {
+				return "", "", fmt.Errorf("invalid quoted path")
+			}
+			field, _ = strconv.Unquote(quoted)
+			rest = rest[len(quoted):]
+		} else if i := strings.IndexAny(rest, " \t"); i >= 0 {
+			field, rest = rest[:i], rest[i:]
+		} else {
+			rest = ""
+		}
+		fields = append(fields, field)
+	}
+	if len(fields) != 2 {
+		return "", "", fmt.Errorf("want a target path and a source path")
+	}
+	return fields[0], fields[1], nil
+}
+
+// addEntry adds the file or directory at the given source path on the host
+// to the given root directory at the given target path.
+func addEntry(root *vfat.Directory, target, source string) error {
+	target = path.Clean("/" + filepath.ToSlash(target))[1:]
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		// A directory's contents are merged into any directory already
+		// at the target, so that a manifest can add to the source
+		// directory or to directories created for earlier targets.
+		dir, err := makeDirs(root, target)
+		if err != nil {
+			return err
+		}
+		sub, err := vfat.DirectoryFromFS(os.DirFS(source), ".")
+		if err != nil {
+			return err
+		}
+		for _, entry := range sub.Dirs {
+			if err := addDir(dir, entry); err != nil {
+				return err
+			}
+		}
+		for _, entry := range sub.Files {
+			if err := addFile(dir, entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if target == "" {
+		return fmt.Errorf("%s must be a directory to become the root directory", source)
+	}
+	parentPath, name := path.Split(target)
+	parent, err := makeDirs(root, parentPath)
+	if err != nil {
+		return err
+	}
+	file, err := vfat.FileFromFS(os.DirFS(filepath.Dir(source)), filepath.Base(source))
+	if err != nil {
+		return err
+	}
+	file.Name = name
+	return addFile(parent, file)
+}
+
+// makeDirs returns the directory at the given slash-separated path within
+// the given root, creating it and any of its parents that don't exist.
+func makeDirs(root *vfat.Directory, dirPath string) (*vfat.Directory, error) {
+	dir := root
+	for _, name := range strings.Split(strings.Trim(dirPath, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		i := findEntry(dir, name)
+		switch {
+		case i < 0:
+			dir.Dirs = append(dir.Dirs, vfat.DirEntryDir{
+				DirEntryCommon: vfat.DirEntryCommon{Name: name},
+				Directory:      &vfat.Directory{},
+			})
+			dir = dir.Dirs[len(dir.Dirs)-1].Directory
+		case i < len(dir.Dirs):
+			dir = dir.Dirs[i].Directory
+		default:
+			return nil, fmt.Errorf("%s is a file, not a directory", path.Join(dirPath, name))
+		}
+	}
+	return dir, nil
+}
+
+// addDir adds the given subdirectory to a directory, merging its contents
+// into any subdirectory of the same name that's already there.
+func addDir(dir *vfat.Directory, entry vfat.DirEntryDir) error {
+	i := findEntry(dir, entry.Name)
+	switch {
+	case i < 0:
+		dir.Dirs = append(dir.Dirs, entry)
+		return nil
+	case i >= len(dir.Dirs):
+		return fmt.Errorf("%s is a file, not a directory", entry.Name)
+	}
+	for _, sub := range entry.Directory.Dirs {
+		if err := addDir(dir.Dirs[i].Directory, sub); err != nil {
+			return err
+		}
+	}
+	for _, file := range entry.Directory.Files {
+		if err := addFile(dir.Dirs[i].Directory, file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addFile(dir *vfat.Directory, entry vfat.DirEntryFile) error {
+	if findEntry(dir, entry.Name) >= 0 {
+		return fmt.Errorf("%s is listed more than once", entry.Name)
+	}
+	dir.Files = append(dir.Files, entry)
+	return nil
+}
+
+// findEntry returns the index of the entry with the given name in the
+// directory, counting subdirectories first and then files, or -1 if there
+// is none. Names are compared case-insensitively, as they are in FAT.
+func findEntry(dir *vfat.Directory, name string) int {
+	for i, entry := range dir.Dirs {
+		if strings.EqualFold(entry.Name, name) {
+			return i
+		}
+	}
+	for i, entry := range dir.Files {
+		if strings.EqualFold(entry.Name, name) {
+			return len(dir.Dirs) + i
+		}
+	}
+	return -1
 }
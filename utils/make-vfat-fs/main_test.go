@@ -0,0 +1,135 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/apparentlymart/go-fsutil/fsutil"
+	"github.com/apparentlymart/go-fsutil/vfat"
+)
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name, content string) {
+		fn := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fn, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile("src/a.txt", "a")
+	writeFile("src/boot/b.txt", "b")
+	writeFile("extra/kernel", "kernel")
+	writeFile("extra/more/c.txt", "c")
+	writeFile("manifest", `
+# Comments and blank lines are ignored.
+boot/vmlinuz extra/kernel
+"boot/with space.txt" extra/more/c.txt
+boot extra/more
+`)
+	output := filepath.Join(dir, "fs.img")
+
+	err := run([]string{
+		"-o", output,
+		"-manifest", filepath.Join(dir, "manifest"),
+		"-label", "boot",
+		"-volume-id", "1234-ABCD",
+		"-size", "2M",
+		"-fat", "12",
+		filepath.Join(dir, "src"),
+	}, io.Discard)
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+
+	f, err := fsutil.OpenFile(output, fsutil.ReadOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if got, want := f.Region.Length(), 2<<20; got != want {
+		t.Errorf("image is %d bytes; want %d", got, want)
+	}
+	img, err := vfat.Open(f.Region)
+	if err != nil {
+		t.Fatalf("failed to open image: %s", err)
+	}
+	if img.FATType != vfat.FAT12 {
+		t.Errorf("image is %s; want FAT12", img.FATType)
+	}
+	if got, want := img.VolumeID, uint32(0x1234abcd); got != want {
+		t.Errorf("volume ID is 0x%08x; want 0x%08x", got, want)
+	}
+	if got, want := string(img.Label[:]), "BOOT       "; got != want {
+		t.Errorf("label is %q; want %q", got, want)
+	}
+
+	ifs := img.FS()
+	for name, want := range map[string]string{
+		"a.txt":               "a",
+		"boot/b.txt":          "b",
+		"boot/c.txt":          "c",
+		"boot/vmlinuz":        "kernel",
+		"boot/with space.txt": "c",
+	} {
+		got, err := ifs.ReadFile(name)
+		if err != nil {
+			t.Errorf("failed to read %s: %s", name, err)
+			continue
+		}
+		if string(got) != want {
+			t.Errorf("%s contains %q; want %q", name, got, want)
+		}
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	dir := t.TempDir()
+	output := filepath.Join(dir, "fs.img")
+	if err := os.WriteFile(filepath.Join(dir, "big"), make([]byte, 1<<20), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "manifest"), []byte("big big\nBIG big\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := [][]string{
+		{},
+		{"-o", output, "-fat", "24"},
+		{"-o", output, "-label", "much too long"},
+		{"-o", output, "-volume-id", "1234"},
+		{"-o", output, "-size", "lots"},
+		{"-o", output, "-size", "512K", dir},
+		{"-o", output, "-manifest", filepath.Join(dir, "manifest")},
+	}
+	for _, args := range tests {
+		if err := run(args, io.Discard); err == nil {
+			t.Errorf("%q succeeded; want error", args)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := map[string]uint64{
+		"1474560": 1474560,
+		"64k":     64 << 10,
+		"32M":     32 << 20,
+		"2G":      2 << 30,
+		"1T":      1 << 40,
+	}
+	for input, want := range tests {
+		got, err := parseSize(input)
+		if err != nil || got != want {
+			t.Errorf("size %q is %d (%v); want %d", input, got, err, want)
+		}
+	}
+	for _, input := range []string{"", "0", "K", "1.5M", "-1", "20000000T"} {
+		if _, err := parseSize(input); err == nil {
+			t.Errorf("size %q is valid; want error", input)
+		}
+	}
+}
@@ -1,14 +1,22 @@
 package vfat
 
 import (
+	"fmt"
+	"path"
+	"strings"
 	"time"
-	"unicode/utf8"
+	"unicode/utf16"
 
 	"github.com/apparentlymart/go-fsutil/fsutil"
 )
 
 const DirEntrySize = 32
 
+// DotName and DotDotName are the 8.3 names of the entries at the start of
+// each subdirectory that refer to the directory itself and its parent.
+var DotName = [11]byte{'.', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' '}
+var DotDotName = [11]byte{'.', '.', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' '}
+
 type Attributes uint8
 
 const (
@@ -47,52 +55,104 @@ type Directory struct {
 }
 
 // LFNEntryCount returns the number of additional directory entries
-// that are needed to represent this entry's "long filename".
+// that are needed to represent this entry's "long filename", if it needs
+// one at all.
 func (e *DirEntryCommon) LFNEntryCount() int {
-	// Each LFN entry can have 13 UCS-16 characters, and we need to
-	// leave room for the 2-byte null terminator.
-	chars := utf8.RuneCountInString(e.Name) + 1
-	return chars / 13
+	// Each LFN entry can have 13 UCS-2 characters. The name is
+	// null-terminated only if it doesn't exactly fill the final entry.
+	chars := len(utf16.Encode([]rune(e.Name)))
+	return (chars + 12) / 13
 }
 
-// TotalSize returns the total size of the directory and all of the
-// subdirectories and files it returns to, in clusters.
+// TotalClusters returns the total size of the directory and all of the
+// subdirectories and files it returns to, in clusters of
+// DefaultClusterSize bytes.
 //
 // It takes into account cluster, meaning that all file sizes are rounded
-// up to the nearest cluster.
+// up to the nearest cluster. Empty files need no clusters at all.
 func (d *Directory) TotalClusters(isRoot bool) int {
+	return d.totalClusters(DefaultClusterSize, isRoot)
+}
 
-	// Each directory entry takes 32 bytes
-	tableBytes := 0
+func (d *Directory) totalClusters(clusterSize int, isRoot bool) int {
 	dataClusters := 0
 	for _, entry := range d.Dirs {
-		tableBytes += 32 * (entry.LFNEntryCount() + 1)
-		dataClusters += entry.Directory.TotalClusters(false)
+		dataClusters += entry.Directory.totalClusters(clusterSize, false)
 	}
 	for _, entry := range d.Files {
-		tableBytes += 32 * (entry.LFNEntryCount() + 1)
 		fileSize := entry.BodyBuilder.Length()
-		dataClusters += (fileSize / clusterSize) + 1
+		dataClusters += (fileSize + clusterSize - 1) / clusterSize
 	}
-	if isRoot {
-		// Root directory also contains the volume label record
-		tableBytes += 32
+	return dataClusters + d.tableClusters(clusterSize, isRoot)
+}
+
+// tableClusters returns the number of clusters needed for the directory's
+// table, which is always at least one even if the table would fit in less.
+func (d *Directory) tableClusters(clusterSize int, isRoot bool) int {
+	clusters := (d.TableBytes(isRoot) + clusterSize - 1) / clusterSize
+	if clusters == 0 {
+		clusters = 1
 	}
-	return dataClusters + (tableBytes / clusterSize) + 1
+	return clusters
 }
 
-func (d *Directory) TableBytes(isRoot bool) int {
-	// Each directory entry takes 32 bytes
-	tableBytes := 0
+// validateNames returns an error if any entry in the directory or its
+// subdirectories has a name that can't be used as a long filename, or a
+// name that matches another in the same directory when case is ignored,
+// as it is by FAT implementations. dirPath names the directory in error
+// messages.
+func (d *Directory) validateNames(dirPath string) error {
+	seen := make(map[string]string)
+	for _, entry := range d.entries() {
+		if err := validateLongName(entry.Name); err != nil {
+			return fmt.Errorf("in directory %s: %w", dirPath, err)
+		}
+		key := strings.ToUpper(entry.Name)
+		if other, exists := seen[key]; exists {
+			return fmt.Errorf("in directory %s: %q and %q are the same name when case is ignored", dirPath, other, entry.Name)
+		}
+		seen[key] = entry.Name
+	}
 	for _, entry := range d.Dirs {
-		tableBytes += 32 * (entry.LFNEntryCount() + 1)
+		if err := entry.Directory.validateNames(path.Join(dirPath, entry.Name)); err != nil {
+			return err
+		}
 	}
-	for _, entry := range d.Files {
-		tableBytes += 32 * (entry.LFNEntryCount() + 1)
+	return nil
+}
+
+func (d *Directory) TableBytes(isRoot bool) int {
+	// Each directory entry takes 32 bytes, and entries whose names don't
+	// fit in 8.3 form need additional entries for their long filenames.
+	tableBytes := 0
+	shortNames := d.shortNames()
+	for i, entry := range d.entries() {
+		entryCount := 1
+		if shortNames[i].NeedsLFN {
+			entryCount += entry.LFNEntryCount()
+		}
+		tableBytes += DirEntrySize * entryCount
 	}
 	if isRoot {
 		// Root directory also contains the volume label record
-		tableBytes += 32
+		tableBytes += DirEntrySize
+	} else {
+		// Other directories contain the "." and ".." entries
+		tableBytes += 2 * DirEntrySize
 	}
 	return tableBytes
 }
+
+// entries returns the common part of each of the directory's entries,
+// with the subdirectories first and then the files, in the order they
+// are written to the directory table.
+func (d *Directory) entries() []*DirEntryCommon {
+	ret := make([]*DirEntryCommon, 0, len(d.Dirs)+len(d.Files))
+	for i := range d.Dirs {
+		ret = append(ret, &d.Dirs[i].DirEntryCommon)
+	}
+	for i := range d.Files {
+		ret = append(ret, &d.Files[i].DirEntryCommon)
+	}
+	return ret
+}
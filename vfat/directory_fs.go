@@ -0,0 +1,244 @@
+package vfat
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+
+	"github.com/apparentlymart/go-fsutil/fsutil"
+)
+
+// DirectoryFromFS builds a Directory describing the tree rooted at the given
+// directory in an io/fs filesystem, such as one returned by os.DirFS or an
+// embed.FS.
+//
+// Names, modification times and write permissions are taken from the
+// source filesystem. File contents are not read until the resulting
+// Directory is built, so the source must remain available, and its files
+// must not change size, until then.
+//
+// Symbolic links are followed, so a link to a directory adds a copy of
+// that directory's contents. A link that leads back to one of its own
+// parent directories is reported as an error, as long as the source
+// filesystem's FileInfo values can be compared with os.SameFile, as those
+// from os.DirFS can.
+func DirectoryFromFS(fsys fs.FS, root string) (*Directory, error) {
+	if !fs.ValidPath(root) {
+		return nil, &fs.PathError{Op: "readdir", Path: root, Err: fs.ErrInvalid}
+	}
+	info, err := fs.Stat(fsys, root)
+	if err != nil {
+		return nil, err
+	}
+	return directoryFromFS(fsys, root, []fs.FileInfo{info})
+}
+
+// directoryFromFS builds a Directory for the given directory, given the
+// information for it and for each of its parents up to the root, which
+// is used to detect symbolic link cycles.
+func directoryFromFS(fsys fs.FS, dir string, parents []fs.FileInfo) (*Directory, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &Directory{
+		Dirs:  []DirEntryDir{},
+		Files: []DirEntryFile{},
+	}
+
+	for _, entry := range entries {
+		name := path.Join(dir, entry.Name())
+
+		// We use Stat rather than the directory entry's own information
+		// so that symbolic links are followed.
+		info, err := fs.Stat(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+
+		common := commonFromFileInfo(entry.Name(), info)
+
+		switch {
+		case info.IsDir():
+			for _, parent := range parents {
+				if os.SameFile(info, parent) {
+					return nil, fmt.Errorf("symbolic link cycle at %s", name)
+				}
+			}
+			sub, err := directoryFromFS(fsys, name, append(parents, info))
+			if err != nil {
+				return nil, err
+			}
+			ret.Dirs = append(ret.Dirs, DirEntryDir{
+				DirEntryCommon: common,
+				Directory:      sub,
+			})
+		case info.Mode().IsRegular():
+			ret.Files = append(ret.Files, DirEntryFile{
+				DirEntryCommon: common,
+				BodyBuilder: &fsFileRegionBuilder{
+					fsys: fsys,
+					name: name,
+					size: int(info.Size()),
+				},
+			})
+		default:
+			return nil, fmt.Errorf("%s is neither a regular file nor a directory", name)
+		}
+	}
+
+	return ret, nil
+}
+
+// FileFromFS builds a DirEntryFile describing a single regular file in an
+// io/fs filesystem, named after the final element of its path.
+//
+// As with DirectoryFromFS, the file's contents are not read until the
+// filesystem it's added to is built.
+func FileFromFS(fsys fs.FS, name string) (DirEntryFile, error) {
+	if !fs.ValidPath(name) {
+		return DirEntryFile{}, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	info, err := fs.Stat(fsys, name)
+	if err != nil {
+		return DirEntryFile{}, err
+	}
+	if !info.Mode().IsRegular() {
+		return DirEntryFile{}, fmt.Errorf("%s is not a regular file", name)
+	}
+	return DirEntryFile{
+		DirEntryCommon: commonFromFileInfo(path.Base(name), info),
+		BodyBuilder: &fsFileRegionBuilder{
+			fsys: fsys,
+			name: name,
+			size: int(info.Size()),
+		},
+	}, nil
+}
+
+// commonFromFileInfo returns the common directory entry fields for an entry
+// with the given name, taking its modification time and write permission
+// from the given information.
+func commonFromFileInfo(name string, info fs.FileInfo) DirEntryCommon {
+	common := DirEntryCommon{
+		Name:             name,
+		LastModifiedTime: info.ModTime(),
+	}
+	if info.Mode().Perm()&0200 == 0 {
+		common.Attributes |= ReadOnlyAttr
+	}
+	return common
+}
+
+// fsFileRegionBuilder builds a region from the contents of a file in an
+// io/fs filesystem, reading it only when the region is built.
+type fsFileRegionBuilder struct {
+	fsys fs.FS
+	name string
+	size int
+}
+
+func (rb *fsFileRegionBuilder) Length() int {
+	return rb.size
+}
+
+func (rb *fsFileRegionBuilder) Build(r fsutil.Region) error {
+	f, err := rb.fsys.Open(rb.name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// We read directly into the region's own buffers, to avoid making
+	// an additional copy of the file.
+	for _, buf := range r.Slice(0, rb.size) {
+		_, err := io.ReadFull(f, buf)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", rb.name, err)
+		}
+	}
+	return nil
+}
+
+func (rb *fsFileRegionBuilder) PrepareRanges() (fsutil.RangeBuilder, error) {
+	return &fsFileRangeBuilder{rb: rb}, nil
+}
+
+// fsFileRangeBuilder builds ranges of a file in an io/fs filesystem. Ranges
+// are usually requested in order, so it keeps the file open between them
+// and closes it once the final byte has been read, if building fails, or
+// when it is itself closed.
+type fsFileRangeBuilder struct {
+	rb  *fsFileRegionBuilder
+	f   fs.File
+	pos int
+}
+
+func (b *fsFileRangeBuilder) BuildRange(r fsutil.Region, offset int) error {
+	err := b.buildRange(r, offset)
+	if err != nil || b.pos == b.rb.size {
+		b.Close()
+	}
+	return err
+}
+
+func (b *fsFileRangeBuilder) Close() error {
+	if b.f == nil {
+		return nil
+	}
+	err := b.f.Close()
+	b.f = nil
+	return err
+}
+
+func (b *fsFileRangeBuilder) buildRange(r fsutil.Region, offset int) error {
+	length := r.Length()
+	if offset < 0 || length > b.rb.size-offset {
+		return &fsutil.OutOfBoundsError{
+			Offset:       offset,
+			Length:       length,
+			RegionLength: b.rb.size,
+		}
+	}
+	if length == 0 {
+		return nil
+	}
+
+	if b.f != nil && offset < b.pos {
+		// We can't go backwards without starting again.
+		b.Close()
+	}
+	if b.f == nil {
+		f, err := b.rb.fsys.Open(b.rb.name)
+		if err != nil {
+			return err
+		}
+		b.f = f
+		b.pos = 0
+	}
+
+	if skip := int64(offset - b.pos); skip > 0 {
+		var err error
+		if seeker, ok := b.f.(io.Seeker); ok {
+			_, err = seeker.Seek(skip, io.SeekCurrent)
+		} else {
+			_, err = io.CopyN(io.Discard, b.f, skip)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", b.rb.name, err)
+		}
+		b.pos = offset
+	}
+
+	for _, buf := range r {
+		n, err := io.ReadFull(b.f, buf)
+		b.pos += n
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", b.rb.name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package vfat
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/apparentlymart/go-fsutil/fsutil"
+)
+
+func TestDirectoryFromFS(t *testing.T) {
+	src := fstest.MapFS{
+		"root/a.txt":          {Data: []byte("a")},
+		"root/sub/b.txt":      {Data: bytes.Repeat([]byte("b"), 10000)},
+		"root/sub/empty.txt":  {Data: []byte{}},
+		"root/sub/locked.txt": {Data: []byte("locked"), Mode: 0444},
+		"other.txt":           {Data: []byte("not included")},
+	}
+
+	dir, err := DirectoryFromFS(src, "root")
+	if err != nil {
+		t.Fatalf("failed to build directory: %s", err)
+	}
+
+	if got, want := len(dir.Dirs), 1; got != want {
+		t.Fatalf("root has %d directories; want %d", got, want)
+	}
+	if got, want := len(dir.Files), 1; got != want {
+		t.Fatalf("root has %d files; want %d", got, want)
+	}
+	sub := dir.Dirs[0].Directory
+	if got, want := len(sub.Files), 3; got != want {
+		t.Fatalf("sub has %d files; want %d", got, want)
+	}
+	if sub.Files[2].Name != "locked.txt" || sub.Files[2].Attributes&ReadOnlyAttr == 0 {
+		t.Errorf("locked.txt is not read-only")
+	}
+
+	ifs := buildTestImage(t, &Filesystem{RootDir: dir}).FS()
+	for _, name := range []string{"a.txt", "sub/b.txt", "sub/empty.txt", "sub/locked.txt"} {
+		got, err := ifs.ReadFile(name)
+		if err != nil {
+			t.Errorf("failed to read %s: %s", name, err)
+			continue
+		}
+		if want := src["root/"+name].Data; !bytes.Equal(got, want) {
+			t.Errorf("%s contains %q; want %q", name, got, want)
+		}
+	}
+}
+
+func TestFileFromFS(t *testing.T) {
+	src := fstest.MapFS{
+		"dir/locked.txt": {Data: []byte("locked"), Mode: 0444},
+		"dir/sub":        {Mode: fs.ModeDir},
+	}
+
+	file, err := FileFromFS(src, "dir/locked.txt")
+	if err != nil {
+		t.Fatalf("failed to build file: %s", err)
+	}
+	if file.Name != "locked.txt" || file.Attributes&ReadOnlyAttr == 0 {
+		t.Errorf("file is %q with attributes 0x%02x; want read-only locked.txt", file.Name, file.Attributes)
+	}
+
+	ifs := buildTestImage(t, &Filesystem{RootDir: &Directory{Files: []DirEntryFile{file}}}).FS()
+	if got, err := ifs.ReadFile("locked.txt"); err != nil || string(got) != "locked" {
+		t.Errorf("locked.txt contains %q (%v); want %q", got, err, "locked")
+	}
+
+	for _, name := range []string{"dir/sub", "dir/missing.txt", "/dir/locked.txt"} {
+		if _, err := FileFromFS(src, name); err == nil {
+			t.Errorf("succeeded in building %s; want error", name)
+		}
+	}
+}
+
+func TestDirectoryFromFSSymlinkCycle(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "src", "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "src", "sub", "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("sub", filepath.Join(root, "src", "link")); err != nil {
+		t.Skipf("can't create symbolic links: %s", err)
+	}
+
+	// A link to a sibling is followed.
+	dir, err := DirectoryFromFS(os.DirFS(root), "src")
+	if err != nil {
+		t.Fatalf("failed to build directory: %s", err)
+	}
+	if got, want := len(dir.Dirs), 2; got != want {
+		t.Errorf("src has %d directories; want %d", got, want)
+	}
+
+	// A link to a parent is a cycle.
+	if err := os.Symlink("..", filepath.Join(root, "src", "sub", "up")); err != nil {
+		t.Fatal(err)
+	}
+	_, err = DirectoryFromFS(os.DirFS(root), "src")
+	if err == nil || !strings.Contains(err.Error(), "symbolic link cycle at src/link/up") {
+		t.Errorf("error is %v; want a symbolic link cycle", err)
+	}
+}
+
+// countingFS is an fs.FS that counts how many of its files are open.
+type countingFS struct {
+	fs.FS
+	open int
+}
+
+func (c *countingFS) Open(name string) (fs.File, error) {
+	f, err := c.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	c.open++
+	return &countingFile{File: f, fs: c}, nil
+}
+
+func (c *countingFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return fs.ReadDir(c.FS, name)
+}
+
+type countingFile struct {
+	fs.File
+	fs *countingFS
+}
+
+func (f *countingFile) Close() error {
+	f.fs.open--
+	return f.File.Close()
+}
+
+// failingWriter accepts the given number of writes and fails any after.
+type failingWriter struct {
+	writes int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.writes == 0 {
+		return 0, io.ErrClosedPipe
+	}
+	w.writes--
+	return len(p), nil
+}
+
+func TestDirectoryFromFSAbortedStream(t *testing.T) {
+	src := fstest.MapFS{
+		"root/big.bin": {Data: bytes.Repeat([]byte("big"), 1<<20)},
+	}
+
+	// The writer fails partway through the file.
+	cfs := &countingFS{FS: src}
+	dir, err := DirectoryFromFS(cfs, "root")
+	if err != nil {
+		t.Fatalf("failed to build directory: %s", err)
+	}
+	_, err = fsutil.BuildTo(&failingWriter{writes: 1}, &Filesystem{RootDir: dir})
+	if !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("error is %v; want %v", err, io.ErrClosedPipe)
+	}
+	if cfs.open != 0 {
+		t.Errorf("%d files are still open after the writer failed", cfs.open)
+	}
+
+	// The file is shorter than it was when the directory was built.
+	dir, err = DirectoryFromFS(cfs, "root")
+	if err != nil {
+		t.Fatalf("failed to build directory: %s", err)
+	}
+	src["root/big.bin"].Data = src["root/big.bin"].Data[:1<<20]
+	if _, err := fsutil.BuildTo(io.Discard, &Filesystem{RootDir: dir}); err == nil {
+		t.Errorf("succeeded with truncated file; want error")
+	}
+	if cfs.open != 0 {
+		t.Errorf("%d files are still open after reading failed", cfs.open)
+	}
+}
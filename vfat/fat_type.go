@@ -0,0 +1,149 @@
+package vfat
+
+import (
+	"fmt"
+
+	"github.com/apparentlymart/go-fsutil/fsutil"
+)
+
+// FATType selects the width of the entries in the file allocation table,
+// which determines the number of clusters a filesystem can have.
+type FATType int
+
+const (
+	// AutoFATType chooses the smallest type that can represent the number
+	// of clusters the filesystem needs.
+	AutoFATType FATType = 0
+
+	FAT12 FATType = 12
+	FAT16 FATType = 16
+	FAT32 FATType = 32
+)
+
+// The cluster counts that determine which FAT type a filesystem is
+// considered to have. Implementations decide the type based only on
+// the cluster count, so a filesystem must have a count in the range for
+// its type to be read correctly.
+const maxFAT12Clusters = 4084
+const maxFAT16Clusters = 65524
+const maxFAT32Clusters = 0x0ffffff5
+
+func (t FATType) String() string {
+	switch t {
+	case AutoFATType:
+		return "automatic"
+	case FAT12, FAT16, FAT32:
+		return fmt.Sprintf("FAT%d", int(t))
+	default:
+		return fmt.Sprintf("FATType(%d)", int(t))
+	}
+}
+
+// fatTypeForClusters returns the FAT type that implementations will
+// assume for a filesystem with the given number of data clusters.
+func fatTypeForClusters(count uint32) FATType {
+	switch {
+	case count <= maxFAT12Clusters:
+		return FAT12
+	case count <= maxFAT16Clusters:
+		return FAT16
+	default:
+		return FAT32
+	}
+}
+
+// clusterRange returns the minimum and maximum number of data clusters
+// that a filesystem of this type may have.
+func (t FATType) clusterRange() (uint32, uint32) {
+	switch t {
+	case FAT12:
+		return 1, maxFAT12Clusters
+	case FAT16:
+		return maxFAT12Clusters + 1, maxFAT16Clusters
+	default:
+		return maxFAT16Clusters + 1, maxFAT32Clusters
+	}
+}
+
+// signature returns the filesystem type string recorded in the boot record.
+func (t FATType) signature() []byte {
+	if t == FAT32 {
+		return FSTypeSignature
+	}
+	return []byte(fmt.Sprintf("FAT%d   ", int(t)))
+}
+
+// fatBytes returns the number of bytes needed for a FAT with the given
+// number of entries.
+func (t FATType) fatBytes(entries uint32) uint32 {
+	return (entries*uint32(t) + 7) / 8
+}
+
+// mask returns the bits of a FAT entry that are significant.
+func (t FATType) mask() uint32 {
+	if t == FAT32 {
+		// The top four bits of FAT32 entries are reserved.
+		return 0x0fffffff
+	}
+	return (1 << uint(t)) - 1
+}
+
+// endOfChain returns the value used to mark the last cluster in a chain.
+func (t FATType) endOfChain() uint32 {
+	return t.mask()
+}
+
+// minEndOfChain returns the smallest value that implementations
+// recognize as marking the last cluster in a chain.
+func (t FATType) minEndOfChain() uint32 {
+	return t.mask() &^ 0x7
+}
+
+// badCluster returns the value used to mark a cluster as unusable.
+func (t FATType) badCluster() uint32 {
+	return t.minEndOfChain() - 1
+}
+
+// fatID returns the value of the first FAT entry, which records the
+// media descriptor.
+func (t FATType) fatID() uint32 {
+	return t.mask()&^0xff | mediaDescriptor
+}
+
+// readEntry returns the FAT entry for the given cluster.
+func (t FATType) readEntry(fat fsutil.Region, cluster uint32) uint32 {
+	switch t {
+	case FAT12:
+		// Entries are packed so that each pair of them shares three bytes.
+		word := uint32(fat.ReadU16LE(int(cluster + cluster/2)))
+		if cluster%2 != 0 {
+			word >>= 4
+		}
+		return word & 0xfff
+	case FAT16:
+		return uint32(fat.ReadU16LE(int(cluster * 2)))
+	default:
+		return fat.ReadU32LE(int(cluster*4)) & 0x0fffffff
+	}
+}
+
+// writeEntry sets the FAT entry for the given cluster, retaining any bits
+// that are shared with neighbouring entries or reserved.
+func (t FATType) writeEntry(fat fsutil.Region, cluster uint32, val uint32) {
+	switch t {
+	case FAT12:
+		addr := int(cluster + cluster/2)
+		word := fat.ReadU16LE(addr)
+		if cluster%2 != 0 {
+			word = word&0x000f | uint16(val&0xfff)<<4
+		} else {
+			word = word&0xf000 | uint16(val&0xfff)
+		}
+		fat.WriteU16LE(addr, word)
+	case FAT16:
+		fat.WriteU16LE(int(cluster*2), uint16(val))
+	default:
+		old := fat.ReadU32LE(int(cluster * 4))
+		fat.WriteU32LE(int(cluster*4), old&0xf0000000|val&0x0fffffff)
+	}
+}
@@ -2,6 +2,8 @@ package vfat
 
 import (
 	"fmt"
+	"strings"
+	"time"
 
 	"golang.org/x/text/encoding/unicode"
 
@@ -24,15 +26,35 @@ var FSInfoSignature3 = []byte{0x00, 0x00, 0x55, 0xaa}
 const FATID = 0x0ffffff8
 const EndOfChain uint32 = 0x0fffffff
 
-const sectorSize = 512
-const clusterSize = 4096
+// The geometry used when the corresponding Filesystem fields are zero.
+const DefaultSectorSize = 512
+const DefaultClusterSize = 4096
+const DefaultFATCount = 1
+
+// The number of root directory entries FAT12 and FAT16 filesystems have
+// room for when RootEntryCount is zero, unless more are needed.
+const DefaultRootEntryCount = 512
+
 const fatEntrySize = 4
-const sectorsPerCluster = clusterSize / sectorSize
 
-// Two reserved sectors:
+// Media Descriptor (Fixed Disk)
+const mediaDescriptor = 0xf8
+
+// At least two reserved sectors on FAT32, though the reserved area is
+// padded out so that the data area is cluster-aligned:
 // - Boot record
 // - FSInfo
-const reservedSectors = 2
+// FAT12 and FAT16 have no FSInfo, and so need only the boot record.
+const minReservedSectors = 2
+const minReservedSectorsFAT16 = 1
+
+// The sector of the FSInfo structure, which always immediately follows
+// the boot record.
+const fsInfoSector = 1
+
+// Each LFN entry holds 13 two-byte characters.
+const lfnEntryBytes = 26
+const lfnLastEntryFlag = 0x40
 
 var LFNPadding = []byte{
 	0xff, 0xff,
@@ -50,155 +72,911 @@ var LFNPadding = []byte{
 	0xff, 0xff,
 }
 
+// NoLabel is the volume label recorded in the boot record when the
+// filesystem has no label of its own.
+var NoLabel = [11]byte{'N', 'O', ' ', 'N', 'A', 'M', 'E', ' ', ' ', ' ', ' '}
+
+var noLabel [11]byte
+
+// MakeLabel converts the given string to a volume label, for use as a
+// Filesystem's Label. Labels are recorded in uppercase, and may contain
+// at most 11 of the characters allowed in 8.3 names, or spaces. An empty
+// string produces an empty label, meaning that the filesystem has none.
+func MakeLabel(s string) ([11]byte, error) {
+	var ret [11]byte
+	if s == "" {
+		return ret, nil
+	}
+	upper := strings.ToUpper(s)
+	if len(upper) > len(ret) {
+		return ret, fmt.Errorf("volume label %q is longer than %d characters", s, len(ret))
+	}
+	for _, c := range upper {
+		if !(c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == ' ' || strings.ContainsRune(shortNameSpecials, c)) {
+			return ret, fmt.Errorf("volume label %q contains invalid character %q", s, c)
+		}
+	}
+	copy(ret[:], "           ")
+	copy(ret[:], upper)
+	return ret, nil
+}
+
 type Filesystem struct {
 	HiddenSectorCount uint32
 	VolumeID          uint32
 	Label             [11]byte
 	ExtraClusterCount uint32
 
+	// TotalSize, if non-zero, is the exact size of the filesystem in
+	// bytes, which must be a multiple of the sector size. Whatever space
+	// is not needed for the content is left free, and so ExtraClusterCount
+	// must be zero.
+	//
+	// If ClusterSize is zero, the cluster size is chosen so that the
+	// filesystem has a valid number of clusters for its FAT type, starting
+	// with DefaultClusterSize and then trying smaller and then larger
+	// sizes. It is an error if the content does not fit.
+	TotalSize uint64
+
+	// SectorSize is the size of a sector in bytes, which must be 512,
+	// 1024, 2048 or 4096. If zero, DefaultSectorSize is used.
+	SectorSize uint32
+
+	// ClusterSize is the size of a cluster in bytes, which must be a
+	// power-of-two multiple of the sector size no greater than 128
+	// sectors or 64KiB. If zero, DefaultClusterSize is used.
+	ClusterSize uint32
+
+	// FATCount is the number of identical copies of the FAT to write.
+	// If zero, DefaultFATCount is used.
+	FATCount uint32
+
+	// ReservedSectors is the minimum number of sectors to reserve at the
+	// start of the filesystem for the boot record, FSInfo and other
+	// boot-related data. The reserved area may be extended beyond this
+	// so that the data area is aligned to a cluster boundary.
+	ReservedSectors uint32
+
+	// BackupBootSector, if non-zero, is the sector where copies of the
+	// boot record and FSInfo sectors are written, conventionally 6. The
+	// reserved area must be large enough to contain both copies. This
+	// applies only to FAT32, and is ignored for other types.
+	BackupBootSector uint32
+
+	// FATType selects the type of FAT to write. If zero, the smallest type
+	// that can represent the necessary number of clusters is chosen.
+	//
+	// If a type is selected that requires more clusters than are needed,
+	// free clusters are added to reach its minimum, since implementations
+	// determine the type based on the number of clusters. It is an error
+	// to select a type that cannot represent enough clusters.
+	FATType FATType
+
+	// RootEntryCount is the number of entries in the fixed-size root
+	// directory of a FAT12 or FAT16 filesystem, which must fill a whole
+	// number of sectors. If zero, DefaultRootEntryCount is used, or more
+	// if the root directory needs more. It is not used for FAT32.
+	RootEntryCount uint32
+
+	// Location is the time zone in which timestamps are recorded, since
+	// FAT records only wall-clock times. If nil, each timestamp is
+	// recorded in its own location.
+	Location *time.Location
+
+	// StrictTimes causes Build to return a *TimeRangeError when a
+	// timestamp falls outside of the range FAT can represent, rather than
+	// clamping it to that range.
+	StrictTimes bool
+
+	// Reproducible causes Build to produce identical output for identical
+	// content, regardless of the order of each directory's entries, of
+	// when the content was last modified, or of what the region contained
+	// beforehand. Each directory's entries are sorted by name, timestamps
+	// are clamped to SourceDate and recorded in UTC unless Location is
+	// set, the VolumeID is derived from a hash of the content unless it's
+	// set, and every byte not otherwise written is zeroed.
+	//
+	// Deriving the VolumeID means that each file body is built twice.
+	Reproducible bool
+
+	// SourceDate is the latest timestamp recorded when Reproducible is
+	// set, with any later ones clamped to it. If zero, it's taken from the
+	// SOURCE_DATE_EPOCH environment variable, and if that isn't set either
+	// then it's the earliest time FAT can record, midnight on 1 January
+	// 1980 in Location, so that every timestamp is recorded as that time.
+	SourceDate time.Time
+
 	RootDir *Directory
 }
 
+// Validate checks that the filesystem's geometry settings are valid,
+// returning an error describing the first problem found if not.
+func (fs *Filesystem) Validate() error {
+	sectorSize := fs.sectorSize()
+	switch sectorSize {
+	case 512, 1024, 2048, 4096:
+	default:
+		return fmt.Errorf("sector size %d is not 512, 1024, 2048 or 4096", sectorSize)
+	}
+
+	clusterSize := fs.clusterSize()
+	spc := clusterSize / sectorSize
+	if clusterSize%sectorSize != 0 || spc&(spc-1) != 0 || spc > 128 || clusterSize > 65536 {
+		return fmt.Errorf(
+			"cluster size %d is not a power-of-two multiple of sector size %d, of at most 128 sectors and 64KiB",
+			clusterSize, sectorSize,
+		)
+	}
+
+	// The reserved area may be padded by up to one cluster, and must
+	// still fit in the 16-bit field that records its size.
+	if fs.reservedSectors(FAT32)+spc > 0xffff {
+		return fmt.Errorf("%d reserved sectors is too many", fs.reservedSectors(FAT32))
+	}
+
+	switch fs.FATType {
+	case AutoFATType, FAT12, FAT16, FAT32:
+	default:
+		return fmt.Errorf("unsupported FAT type %s", fs.FATType)
+	}
+
+	entriesPerSector := sectorSize / DirEntrySize
+	if fs.RootEntryCount%entriesPerSector != 0 || fs.RootEntryCount > 0xffff {
+		return fmt.Errorf(
+			"root entry count %d is not a multiple of %d no greater than 65535",
+			fs.RootEntryCount, entriesPerSector,
+		)
+	}
+
+	if fs.FATCount > 255 {
+		return fmt.Errorf("FAT count %d is greater than 255", fs.FATCount)
+	}
+
+	if fs.BackupBootSector != 0 {
+		if fs.BackupBootSector <= fsInfoSector {
+			return fmt.Errorf("backup boot sector %d overlaps the boot record or FSInfo", fs.BackupBootSector)
+		}
+		if fs.BackupBootSector+2 > fs.reservedSectors(FAT32) {
+			return fmt.Errorf(
+				"backup boot sector %d and its FSInfo don't fit in %d reserved sectors",
+				fs.BackupBootSector, fs.reservedSectors(FAT32),
+			)
+		}
+	}
+
+	if fs.TotalSize != 0 {
+		if fs.TotalSize%uint64(sectorSize) != 0 || fs.TotalSize/uint64(sectorSize) > 0xffffffff {
+			return fmt.Errorf(
+				"total size %d is not a multiple of sector size %d, of at most 2^32-1 sectors",
+				fs.TotalSize, sectorSize,
+			)
+		}
+		if fs.ExtraClusterCount != 0 {
+			return fmt.Errorf("ExtraClusterCount must be zero when TotalSize is set")
+		}
+	}
+
+	if fs.RootDir == nil {
+		return fmt.Errorf("filesystem has no root directory")
+	}
+
+	return nil
+}
+
+func (fs *Filesystem) sectorSize() uint32 {
+	if fs.SectorSize == 0 {
+		return DefaultSectorSize
+	}
+	return fs.SectorSize
+}
+
+func (fs *Filesystem) clusterSize() uint32 {
+	if fs.ClusterSize == 0 {
+		return DefaultClusterSize
+	}
+	return fs.ClusterSize
+}
+
+func (fs *Filesystem) fatCount() uint32 {
+	if fs.FATCount == 0 {
+		return DefaultFATCount
+	}
+	return fs.FATCount
+}
+
+func (fs *Filesystem) reservedSectors(fatType FATType) uint32 {
+	min := uint32(minReservedSectors)
+	if fatType != FAT32 {
+		min = minReservedSectorsFAT16
+	}
+	if fs.ReservedSectors < min {
+		return min
+	}
+	return fs.ReservedSectors
+}
+
+// rootEntryCount returns the number of entries to allocate for the fixed
+// root directory of a FAT12 or FAT16 filesystem.
+func (fs *Filesystem) rootEntryCount() (uint32, error) {
+	needed := uint32(fs.RootDir.TableBytes(true) / DirEntrySize)
+	if fs.RootEntryCount != 0 {
+		if needed > fs.RootEntryCount {
+			return 0, fmt.Errorf(
+				"root directory needs %d entries, but RootEntryCount is %d",
+				needed, fs.RootEntryCount,
+			)
+		}
+		return fs.RootEntryCount, nil
+	}
+
+	if needed < DefaultRootEntryCount {
+		return DefaultRootEntryCount, nil
+	}
+	entriesPerSector := fs.sectorSize() / DirEntrySize
+	return divCeil(needed, entriesPerSector) * entriesPerSector, nil
+}
+
 type layout struct {
-	DataClusters     uint32
+	SectorSize        uint32
+	ClusterSize       uint32
+	SectorsPerCluster uint32
+	FATCount          uint32
+	FATType           FATType
+
+	// DataClusters is the number of clusters in the data area, including
+	// any that are left free.
+	DataClusters uint32
+
+	// UsedClusters is the number of clusters at the start of the data
+	// area that may be allocated for content. Any after these are free.
+	UsedClusters uint32
+
 	FATSize          uint32
+	FATSectors       uint32
+	ReservedSectors  uint32
+	RootEntryCount   uint32
+	RootDirSectors   uint32
 	OverheadSize     uint32
 	OverheadClusters uint32
-	TotalClusters    uint32
+
+	// TotalSectors is the size of the whole filesystem. This usually
+	// covers exactly the overhead and data clusters, but may include some
+	// unused sectors at the end when TotalSize is set.
+	TotalSectors uint32
 }
 
-func (fs *Filesystem) calcLayout() *layout {
-	reservedSize := uint32(reservedSectors * sectorSize)
-	dataClusters := uint32(fs.RootDir.TotalClusters(true))
+func (fs *Filesystem) calcLayout() (*layout, error) {
+	err := fs.Validate()
+	if err != nil {
+		return nil, err
+	}
+	err = fs.RootDir.validateNames("/")
+	if err != nil {
+		return nil, err
+	}
+	if fs.TotalSize != 0 {
+		return fs.calcSizedLayout()
+	}
 
-	fatSize := uint32(dataClusters * fatEntrySize)
+	sectorSize := fs.sectorSize()
+	clusterSize := fs.clusterSize()
+	fatCount := fs.fatCount()
 
-	overheadSize := reservedSize + fatSize
-	if overheadSize < (2 * clusterSize) {
-		// Must always have at least two clusters of overhead because
-		// the first two entries in the FAT are used for metadata.
-		overheadSize = 2 * clusterSize
+	// On FAT32 the root directory is stored in clusters like any other,
+	// but FAT12 and FAT16 have a separate fixed area for it instead.
+	contentClusters := uint32(fs.RootDir.totalClusters(int(clusterSize), true))
+	rootClusters := uint32(fs.RootDir.tableClusters(int(clusterSize), true))
+
+	fatType := fs.FATType
+	if fatType == AutoFATType {
+		fatType = fatTypeForClusters(contentClusters - rootClusters + fs.ExtraClusterCount)
+		if fatType == FAT32 {
+			fatType = fatTypeForClusters(contentClusters + fs.ExtraClusterCount)
+		}
 	}
 
-	overheadClusters := divCeil(overheadSize, clusterSize)
+	usedClusters := contentClusters
+	rootEntryCount := uint32(0)
+	rootDirSectors := uint32(0)
+	if fatType != FAT32 {
+		usedClusters -= rootClusters
+		rootEntryCount, err = fs.rootEntryCount()
+		if err != nil {
+			return nil, err
+		}
+		rootDirSectors = divCeil(rootEntryCount*DirEntrySize, sectorSize)
+	}
+
+	dataClusters := usedClusters + fs.ExtraClusterCount
 
-	// Do we have so much overhead that it requires extra overhead clusters?
-	if overheadClusters > 2 {
-		fatSize += (overheadClusters - 2) * fatEntrySize
-		overheadSize = reservedSize + fatSize
-		overheadClusters = divCeil(overheadSize, clusterSize)
+	minClusters, maxClusters := fatType.clusterRange()
+	if dataClusters < minClusters {
+		dataClusters = minClusters
+	}
+	if dataClusters > maxClusters {
+		return nil, fmt.Errorf(
+			"filesystem needs %d clusters, but %s allows at most %d",
+			dataClusters, fatType, maxClusters,
+		)
 	}
 
-	totalClusters := overheadClusters + dataClusters + fs.ExtraClusterCount
-	fatSize = totalClusters * fatEntrySize
+	// The FAT has an entry for each cluster in the data area, plus two
+	// additional entries at the start that are used for metadata.
+	fatSize := fatType.fatBytes(dataClusters + 2)
+	fatSectors := divCeil(fatSize, sectorSize)
+
+	fixedSectors := fatCount*fatSectors + rootDirSectors
+	overheadSize := (fs.reservedSectors(fatType) + fixedSectors) * sectorSize
+	overheadClusters := divCeil(overheadSize, clusterSize)
+
+	// We pad out the reserved area so that the data area begins on a
+	// cluster boundary, which keeps the clusters aligned within the image.
+	overheadSize = overheadClusters * clusterSize
+	reserved := (overheadSize / sectorSize) - fixedSectors
+
+	totalClusters := overheadClusters + dataClusters
+
+	return (&layout{
+		SectorSize:        sectorSize,
+		ClusterSize:       clusterSize,
+		SectorsPerCluster: clusterSize / sectorSize,
+		FATCount:          fatCount,
+		FATType:           fatType,
 
-	return &layout{
 		DataClusters:     dataClusters,
+		UsedClusters:     usedClusters,
 		FATSize:          fatSize,
+		FATSectors:       fatSectors,
+		ReservedSectors:  reserved,
+		RootEntryCount:   rootEntryCount,
+		RootDirSectors:   rootDirSectors,
 		OverheadSize:     overheadSize,
 		OverheadClusters: overheadClusters,
-		TotalClusters:    totalClusters,
+		TotalSectors:     totalClusters * (clusterSize / sectorSize),
+	}).check()
+}
+
+// calcSizedLayout calculates the layout of a filesystem of exactly
+// TotalSize bytes.
+func (fs *Filesystem) calcSizedLayout() (*layout, error) {
+	sectorSize := fs.sectorSize()
+	clusterSizes := []uint32{fs.ClusterSize}
+	if fs.ClusterSize == 0 {
+		clusterSizes = nil
+		for size := uint32(DefaultClusterSize); size >= sectorSize; size /= 2 {
+			clusterSizes = append(clusterSizes, size)
+		}
+		for size := uint32(DefaultClusterSize * 2); size <= 65536 && size/sectorSize <= 128; size *= 2 {
+			clusterSizes = append(clusterSizes, size)
+		}
+	}
+
+	// The first layout with a valid number of clusters is the one we
+	// report if the content doesn't fit in any of them.
+	var tooSmall *layout
+	for _, clusterSize := range clusterSizes {
+		layout, err := fs.fitLayout(clusterSize)
+		if err != nil {
+			return nil, err
+		}
+		if layout == nil {
+			continue
+		}
+		if layout.UsedClusters <= layout.DataClusters {
+			return layout, nil
+		}
+		if tooSmall == nil {
+			tooSmall = layout
+		}
 	}
+
+	if tooSmall == nil {
+		fatType := fs.FATType
+		if fatType == AutoFATType {
+			return nil, fmt.Errorf("no supported cluster size gives a %d-byte filesystem a valid number of clusters", fs.TotalSize)
+		}
+		return nil, fmt.Errorf("no supported cluster size gives a %d-byte filesystem a valid number of clusters for %s", fs.TotalSize, fatType)
+	}
+	return nil, fmt.Errorf(
+		"content does not fit in %d bytes: it needs %d clusters of %d bytes, but there is room for only %d",
+		fs.TotalSize, tooSmall.UsedClusters, tooSmall.ClusterSize, tooSmall.DataClusters,
+	)
 }
 
+// fitLayout calculates the layout of a filesystem of exactly TotalSize
+// bytes with the given cluster size, returning nil if the resulting number
+// of clusters is not valid for any of the allowed FAT types. The content
+// may not fit in the resulting layout, which the caller must check.
+func (fs *Filesystem) fitLayout(clusterSize uint32) (*layout, error) {
+	sectorSize := fs.sectorSize()
+	spc := clusterSize / sectorSize
+	fatCount := fs.fatCount()
+	totalSectors := uint32(fs.TotalSize / uint64(sectorSize))
+
+	contentClusters := uint32(fs.RootDir.totalClusters(int(clusterSize), true))
+	rootClusters := uint32(fs.RootDir.tableClusters(int(clusterSize), true))
+
+	fatTypes := []FATType{fs.FATType}
+	if fs.FATType == AutoFATType {
+		fatTypes = []FATType{FAT12, FAT16, FAT32}
+	}
+	for _, fatType := range fatTypes {
+		usedClusters := contentClusters
+		rootEntryCount := uint32(0)
+		rootDirSectors := uint32(0)
+		if fatType != FAT32 {
+			usedClusters -= rootClusters
+			var err error
+			rootEntryCount, err = fs.rootEntryCount()
+			if err != nil {
+				return nil, err
+			}
+			rootDirSectors = divCeil(rootEntryCount*DirEntrySize, sectorSize)
+		}
+
+		minReserved := fs.reservedSectors(fatType)
+		fixedSectors := minReserved + rootDirSectors
+		if fixedSectors >= totalSectors {
+			continue
+		}
+
+		// The FAT's size depends on the number of clusters, and the number
+		// of clusters depends on how much space is left after the FATs.
+		// We start with a FAT big enough for every sector to be data and
+		// shrink it until it's no bigger than needed, and then grow it
+		// again if shrinking it made room for clusters it can't cover.
+		fatSectors := divCeil(fatType.fatBytes((totalSectors-fixedSectors)/spc+2), sectorSize)
+		shrinking := true
+		var dataClusters, overheadSectors uint32
+		for {
+			// We pad out the reserved area so that the data area begins
+			// on a cluster boundary, as in calcLayout.
+			overheadSectors = divCeil(fixedSectors+fatCount*fatSectors, spc) * spc
+			if overheadSectors >= totalSectors {
+				dataClusters = 0
+				break
+			}
+			dataClusters = (totalSectors - overheadSectors) / spc
+			needed := divCeil(fatType.fatBytes(dataClusters+2), sectorSize)
+			if needed > fatSectors {
+				shrinking = false
+				fatSectors++
+				continue
+			}
+			if shrinking && needed < fatSectors {
+				fatSectors = needed
+				continue
+			}
+			break
+		}
+		fatSize := fatType.fatBytes(dataClusters + 2)
+
+		minClusters, maxClusters := fatType.clusterRange()
+		if dataClusters < minClusters || dataClusters > maxClusters {
+			continue
+		}
+
+		return (&layout{
+			SectorSize:        sectorSize,
+			ClusterSize:       clusterSize,
+			SectorsPerCluster: spc,
+			FATCount:          fatCount,
+			FATType:           fatType,
+
+			DataClusters:     dataClusters,
+			UsedClusters:     usedClusters,
+			FATSize:          fatSize,
+			FATSectors:       fatSectors,
+			ReservedSectors:  overheadSectors - fatCount*fatSectors - rootDirSectors,
+			RootEntryCount:   rootEntryCount,
+			RootDirSectors:   rootDirSectors,
+			OverheadSize:     overheadSectors * sectorSize,
+			OverheadClusters: overheadSectors / spc,
+			TotalSectors:     totalSectors,
+		}).check()
+	}
+	return nil, nil
+}
+
+// check verifies that the layout is consistent with how a reader will
+// interpret the resulting boot sector, returning the layout itself if so.
+//
+// A reader derives the FAT type and the number of clusters from the sector
+// counts alone, so any mistake in our calculations would cause it to see a
+// different filesystem than the one we built. An error from here is
+// therefore always a bug in this package.
+func (l *layout) check() (*layout, error) {
+	bad := func(format string, args ...interface{}) (*layout, error) {
+		return nil, fmt.Errorf("inconsistent filesystem layout: "+format, args...)
+	}
+
+	spc := l.SectorsPerCluster
+	if l.ClusterSize != spc*l.SectorSize {
+		return bad("%d sectors of %d bytes is not a %d-byte cluster", spc, l.SectorSize, l.ClusterSize)
+	}
+	if l.ReservedSectors < 1 || (l.FATType == FAT32 && l.ReservedSectors < 2) {
+		return bad("only %d reserved sectors", l.ReservedSectors)
+	}
+	if l.FATType == FAT32 && l.RootDirSectors != 0 {
+		return bad("FAT32 has %d root directory sectors", l.RootDirSectors)
+	}
+	if l.RootDirSectors != divCeil(l.RootEntryCount*DirEntrySize, l.SectorSize) {
+		return bad("%d root directory sectors for %d entries", l.RootDirSectors, l.RootEntryCount)
+	}
+	if l.FATSize != l.FATType.fatBytes(l.DataClusters+2) || l.FATSectors != divCeil(l.FATSize, l.SectorSize) {
+		return bad("%d FAT sectors for %d clusters", l.FATSectors, l.DataClusters)
+	}
+
+	overheadSectors := l.ReservedSectors + l.FATCount*l.FATSectors + l.RootDirSectors
+	if overheadSectors*l.SectorSize != l.OverheadSize || l.OverheadClusters*l.ClusterSize != l.OverheadSize {
+		return bad("data area at sector %d does not begin on a cluster boundary", overheadSectors)
+	}
+	if l.TotalSectors < overheadSectors || (l.TotalSectors-overheadSectors)/spc != l.DataClusters {
+		return bad("%d sectors do not have room for exactly %d clusters", l.TotalSectors, l.DataClusters)
+	}
+	if got := fatTypeForClusters(l.DataClusters); got != l.FATType {
+		return bad("%d clusters would make the filesystem %s rather than %s", l.DataClusters, got, l.FATType)
+	}
+	return l, nil
+}
+
+// Length returns the size of the filesystem in bytes.
+//
+// If the filesystem is invalid, Length returns zero and Build returns an
+// error describing the problem.
 func (fs *Filesystem) Length() int {
-	layout := fs.calcLayout()
-	return int(layout.TotalClusters * clusterSize)
+	layout, err := fs.calcLayout()
+	if err != nil {
+		return 0
+	}
+	return int(layout.TotalSectors) * int(layout.SectorSize)
 }
 
-func (fs *Filesystem) Build(region fsutil.Region) {
-	bootRecord := region.Slice(0, sectorSize)
+// ZeroRanges returns the parts of the filesystem that Build leaves as zero
+// bytes: the free clusters at the end of the data area, and the parts of
+// each FAT that describe them. This allows fsutil.BuildFile to create a
+// sparse file when the filesystem has a lot of free space.
+func (fs *Filesystem) ZeroRanges() []fsutil.ByteRange {
+	layout, err := fs.calcLayout()
+	if err != nil {
+		return nil
+	}
+
+	sectorSize := layout.SectorSize
+	fatAreaSize := layout.FATSectors * sectorSize
+
+	// Free clusters have zero FAT entries, so the FATs are zero from the
+	// first byte that belongs only to free entries. (FAT12 entries can
+	// share a byte with their neighbours.)
+	usedFATBytes := layout.FATType.fatBytes(layout.UsedClusters + 2)
 
-	layout := fs.calcLayout()
-	sectorsPerFAT := divCeil(layout.FATSize, sectorSize)
-	nextCluster := uint32(layout.OverheadClusters)
-	totalSectors := uint32(layout.TotalClusters * sectorsPerCluster)
-	if nextCluster < 2 {
-		// Data can't occupy clusters 0 or 1 because the FAT entries
-		// for these clusters are used for other purposes.
-		nextCluster = 2
+	var ranges []fsutil.ByteRange
+	for i := uint32(0); i < layout.FATCount; i++ {
+		fatStart := (layout.ReservedSectors + i*layout.FATSectors) * sectorSize
+		ranges = append(ranges, fsutil.ByteRange{
+			Offset: int(fatStart + usedFATBytes),
+			Length: int(fatAreaSize - usedFATBytes),
+		})
 	}
 
+	// Everything after the used clusters is free, including any sectors
+	// at the end that aren't part of a cluster.
+	freeStart := int(layout.OverheadSize + layout.UsedClusters*layout.ClusterSize)
+	ranges = append(ranges, fsutil.ByteRange{
+		Offset: freeStart,
+		Length: int(layout.TotalSectors)*int(sectorSize) - freeStart,
+	})
+	return ranges
+}
+
+// Build writes the filesystem into the given region, which must be at
+// least Length bytes long. It returns an error if any entry has a name
+// that can't be used as a long filename, or the same name as another
+// entry in its directory when case is ignored.
+//
+// If building fails then the region may contain a partially-written
+// filesystem, which should be discarded.
+func (fs *Filesystem) Build(region fsutil.Region) error {
+	layout, err := fs.calcLayout()
+	if err != nil {
+		return err
+	}
+	length := int(layout.TotalSectors) * int(layout.SectorSize)
+	if err := region.Check(0, length); err != nil {
+		return err
+	}
+	fs, err = fs.reproducible()
+	if err != nil {
+		return err
+	}
+	if fs.Reproducible {
+		// Build doesn't otherwise write the free space, nor the unused
+		// parts of tables and clusters.
+		for _, buf := range region.Slice(0, length) {
+			for i := range buf {
+				buf[i] = 0
+			}
+		}
+	}
+
+	data := &regionDataArea{
+		region: region.Slice(
+			int(layout.OverheadSize),
+			int(layout.DataClusters*layout.ClusterSize),
+		).Indexed(),
+	}
+	return fs.build(layout, region, data)
+}
+
+// PrepareRanges prepares to build the filesystem in separate parts, such
+// as when writing it with fsutil.BuildTo.
+//
+// The filesystem's metadata, including its FATs and directory tables, is
+// built immediately and held in memory, but the file bodies are built only
+// as their ranges are requested. A file body that is not itself a
+// fsutil.RangeRegionBuilder is held in memory while it is being written.
+//
+// As with fsutil.PrepareRanges, the result must be passed to
+// fsutil.CloseRanges once building is finished, to release any files that
+// are open for the file bodies.
+func (fs *Filesystem) PrepareRanges() (fsutil.RangeBuilder, error) {
+	layout, err := fs.calcLayout()
+	if err != nil {
+		return nil, err
+	}
+	fs, err = fs.reproducible()
+	if err != nil {
+		return nil, err
+	}
+
+	// Unlike Build, we always produce zero bytes where we don't write
+	// anything, since the overhead and tables are built into new buffers
+	// and fsutil.RangeParts zero-fills the gaps between parts.
+	overhead := make([]byte, layout.OverheadSize)
+	data := &rangeDataArea{
+		start: int(layout.OverheadSize),
+	}
+	if err := fs.build(layout, fsutil.RegionForBytes(overhead), data); err != nil {
+		data.parts.Close()
+		return nil, err
+	}
+
+	parts := fsutil.RangeParts{
+		{Offset: 0, Length: len(overhead), Builder: &fsutil.BufferRegionBuilder{Buffer: overhead}},
+	}
+	return append(parts, data.parts...), nil
+}
+
+// build writes the filesystem's reserved sectors, FATs and root directory
+// area into the given region, which must cover at least the filesystem's
+// overhead, and writes directory tables and file bodies into the given
+// data area.
+func (fs *Filesystem) build(layout *layout, region fsutil.Region, data dataArea) error {
+	fatType := layout.FATType
+	sectorSize := layout.SectorSize
+	clusterSize := int(layout.ClusterSize)
+	totalSectors := layout.TotalSectors
+
+	bootRecord := region.Slice(0, int(sectorSize))
+
+	// Data can't occupy clusters 0 or 1 because the FAT entries
+	// for these clusters are used for other purposes, so cluster 2 is
+	// the first cluster in the data area.
+	nextCluster := uint32(2)
+
 	// Main Signatures
 	bootRecord.WriteBytes(0, BasicSignature)
 	bootRecord.WriteU16LE(0x1fe, BootableSignature)
 
 	// BIOS Parameter Block
-	bootRecord.WriteU16LE(0x00b, sectorSize)
-	bootRecord.WriteU8(0x00d, sectorsPerCluster)
-	bootRecord.WriteU16LE(0x00e, reservedSectors)
-	bootRecord.WriteU8(0x010, 1)     // Number of FATs
-	bootRecord.WriteU16LE(0x011, 0)  // Number of root entries not used on FAT32
-	bootRecord.WriteU8(0x015, 0xf8)  // Media Descriptor (Fixed Disk)
-	bootRecord.WriteU16LE(0x018, 1)  // Physical sectors per track not used
-	bootRecord.WriteU16LE(0x01a, 64) // Number of heads not used
-	bootRecord.WriteU32LE(0x020, totalSectors)
-	bootRecord.WriteU16LE(0x02a, 0) // Version number
-	bootRecord.WriteU32LE(0x024, sectorsPerFAT)
-	bootRecord.WriteU16LE(0x030, 1) // Sector of FSInfo
-	bootRecord.WriteU8(0x042, ExtSignature)
-	bootRecord.WriteU32LE(0x043, fs.VolumeID)
-	bootRecord.WriteBytes(0x047, fs.Label[:])
-	bootRecord.WriteBytes(0x052, FSTypeSignature)
-
-	fsInfo := region.Slice(sectorSize, sectorSize)
-	fsInfo.WriteBytes(0x000, FSInfoSignature1)
-	fsInfo.WriteBytes(0x1e4, FSInfoSignature2)
-	fsInfo.WriteU32LE(0x1e8, 0xffffffff) // Free data clusters not known yet
-	fsInfo.WriteU32LE(0x1ec, 0xffffffff) // No most recent data cluster
-	fsInfo.WriteBytes(0x1fc, FSInfoSignature3)
-
-	fat := region.Slice(reservedSectors*sectorSize, int(layout.FATSize))
-	fat.WriteU32LE(0, FATID)
-	fat.WriteU32LE(4, EndOfChain) // End of chain marker used elsewhere in FAT
+	bpb := biosParameterBlock{
+		BytesPerSector:    uint16(sectorSize),
+		SectorsPerCluster: uint8(layout.SectorsPerCluster),
+		ReservedSectors:   uint16(layout.ReservedSectors),
+		FATCount:          uint8(layout.FATCount),
+		RootEntryCount:    uint16(layout.RootEntryCount),
+		MediaDescriptor:   mediaDescriptor,
+		SectorsPerTrack:   1,  // Not used
+		HeadCount:         64, // Not used
+		HiddenSectors:     fs.HiddenSectorCount,
+	}
+	if totalSectors <= 0xffff && fatType != FAT32 {
+		bpb.TotalSectors16 = uint16(totalSectors)
+	} else {
+		bpb.TotalSectors32 = totalSectors
+	}
+	if fatType != FAT32 {
+		bpb.SectorsPerFAT16 = uint16(layout.FATSectors)
 
-	// Now we'll walk the caller's provided directory tree and produce
-	// the actual filesystem data.
+		// The jump instruction skips over the shorter BPB
+		bootRecord.WriteU8(0x001, 0x3c)
+	}
+	if err := bootRecord.WriteStruct(0, &bpb); err != nil {
+		return err
+	}
 
-	lfnEncoding := unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM)
-	lfnEncoder := lfnEncoding.NewEncoder()
+	if fatType == FAT32 {
+		// The root cluster is filled in once we've allocated it.
+		err := bootRecord.WriteStruct(0, &fat32ParameterBlock{
+			SectorsPerFAT:    layout.FATSectors,
+			Flags:            0, // FAT is mirrored to all copies
+			Version:          0,
+			FSInfoSector:     fsInfoSector,
+			BackupBootSector: uint16(fs.BackupBootSector),
+		})
+		if err != nil {
+			return err
+		}
+	}
 
-	allocCluster := func() uint32 {
-		nextCluster += 1
-		return nextCluster - 1
+	ebpb := extendedParameterBlock{
+		DriveNumber: 0x80, // First fixed disk
+		Signature:   ExtSignature,
+		VolumeID:    fs.VolumeID,
+		Label:       fs.Label,
+	}
+	if ebpb.Label == noLabel {
+		ebpb.Label = NoLabel
+	}
+	copy(ebpb.FSType[:], fatType.signature())
+	if err := bootRecord.WriteStruct(extendedParameterBlockOffset(fatType), &ebpb); err != nil {
+		return err
 	}
 
-	// Writes a directory and returns the cluster where it begins
-	var writeDirectory func(*Directory, bool) uint32
-	writeDirectory = func(dir *Directory, isRoot bool) uint32 {
-		startCluster := allocCluster()
+	var fsInfo fsutil.Region
+	if fatType == FAT32 {
+		fsInfo = region.Slice(int(fsInfoSector*sectorSize), int(sectorSize))
+		// The free space hints are filled in once we've allocated all
+		// of the clusters we need.
+		info := fsInfoSectorFields{
+			FreeClusterCount: 0xffffffff,
+			NextFreeCluster:  0xffffffff,
+		}
+		copy(info.Signature1[:], FSInfoSignature1)
+		copy(info.Signature2[:], FSInfoSignature2)
+		copy(info.Signature3[:], FSInfoSignature3)
+		if err := fsInfo.WriteStruct(0, &info); err != nil {
+			return err
+		}
+	}
 
-		tableBytes := uint32(dir.TableBytes(isRoot))
-		tableClusterCount := divCeil(tableBytes, clusterSize)
-		currentCluster := startCluster
+	fat := region.Slice(int(layout.ReservedSectors*sectorSize), int(layout.FATSize))
+	fatType.writeEntry(fat, 0, fatType.fatID())
+	fatType.writeEntry(fat, 1, fatType.endOfChain()) // End of chain marker used elsewhere in FAT
 
-		for i := uint32(1); i < tableClusterCount; i += 1 {
-			nextCluster := allocCluster()
-			// Write next cluster number into the FAT entry for the
-			// current cluster, creating a chain.
+	// FAT12 and FAT16 have the root directory immediately after the FATs.
+	rootRegion := region.Slice(
+		int((layout.ReservedSectors+layout.FATCount*layout.FATSectors)*sectorSize),
+		int(layout.RootDirSectors*sectorSize),
+	)
 
-			fat.WriteU32LE(int(currentCluster*4), nextCluster)
+	// Now we'll walk the caller's provided directory tree and produce
+	// the actual filesystem data.
 
-			currentCluster = nextCluster
+	// Allocates a chain of consecutive clusters, records the chain in
+	// the FAT, and returns the numbers of the allocated clusters.
+	allocChain := func(count uint32) ([]int, error) {
+		if nextCluster+count > layout.DataClusters+2 {
+			// This can happen only if the content has changed since
+			// we calculated the layout.
+			return nil, fmt.Errorf("filesystem content grew after its length was calculated")
+		}
+
+		clusters := make([]int, count)
+		for i := range clusters {
+			clusters[i] = int(nextCluster)
+			if i > 0 {
+				// Write this cluster number into the FAT entry for the
+				// previous cluster, creating a chain.
+				fatType.writeEntry(fat, uint32(clusters[i-1]), nextCluster)
+			}
+			nextCluster += 1
 		}
 
 		// Now write the "End of chain" marker into the FAT entry for
 		// our final cluster.
-		fat.WriteU32LE(int(currentCluster*4), EndOfChain)
+		fatType.writeEntry(fat, uint32(clusters[count-1]), fatType.endOfChain())
 
-		// We guarantee that the directory table gets allocated consecutive
-		// clusters, so we can just create a flat sub-region for it.
-		tableRegion := region.Slice(int(startCluster*clusterSize), int(tableClusterCount*clusterSize))
+		return clusters, nil
+	}
+
+	// Returns the offset of the given cluster within the data area.
+	// Cluster numbering starts at 2, so we need to adjust.
+	clusterOffset := func(cluster int) int {
+		return (cluster - 2) * clusterSize
+	}
+
+	// Writes a directory and returns the cluster where it begins. The
+	// directory's own entry is nil for the root directory, and the parent
+	// cluster is zero for the root and its immediate children.
+	var writeDirectory func(*Directory, *DirEntryCommon, uint32) (uint32, error)
+	writeDirectory = func(dir *Directory, self *DirEntryCommon, parentCluster uint32) (uint32, error) {
+		isRoot := self == nil
+
+		var startCluster uint32
+		var tableRegion fsutil.Region
+		if isRoot && fatType != FAT32 {
+			// The root directory has its own area outside of the
+			// clusters, and is recorded as being at cluster zero.
+			tableRegion = rootRegion
+		} else {
+			// Even an empty directory needs a cluster for its table.
+			tableClusterCount := uint32(dir.tableClusters(clusterSize, isRoot))
+			tableClusters, err := allocChain(tableClusterCount)
+			if err != nil {
+				return 0, err
+			}
+			startCluster = uint32(tableClusters[0])
+
+			// We guarantee that the directory table gets allocated
+			// consecutive clusters, so we can just create a flat
+			// sub-region for it.
+			tableRegion = data.table(
+				clusterOffset(tableClusters[0]),
+				int(tableClusterCount)*clusterSize,
+			)
+		}
 
 		entryOffset := 0
 
-		if isRoot {
+		writeShortEntry := func(name [11]byte, caseFlags byte, entry *DirEntryCommon, attrs Attributes, startCluster uint32, size uint32) error {
+			created, err := fs.encodeTime(entry.Name, entry.CreationTime)
+			if err != nil {
+				return err
+			}
+			accessed, err := fs.encodeTime(entry.Name, entry.LastAccessedTime)
+			if err != nil {
+				return err
+			}
+			modified, err := fs.encodeTime(entry.Name, entry.LastModifiedTime)
+			if err != nil {
+				return err
+			}
+
+			dirEntry := shortDirEntry{
+				Name:          name,
+				Attributes:    uint8(attrs),
+				CaseFlags:     caseFlags,
+				CreationTenMs: created.tenMillis,
+				CreationTime:  created.tod,
+				CreationDate:  created.date,
+				AccessDate:    accessed.date,
+				ModifiedTime:  modified.tod,
+				ModifiedDate:  modified.date,
+				Size:          size,
+			}
+			dirEntry.setCluster(startCluster)
+
+			err = tableRegion.WriteStruct(entryOffset, &dirEntry)
+			entryOffset += DirEntrySize
+			return err
+		}
+
+		if isRoot && fs.Label != noLabel {
 			// Special entry for the volume label
-			tableRegion.WriteBytes(0x00, fs.Label[:])
-			tableRegion.WriteU8(0x0b, byte(VolumeIDAttr))
+			err := tableRegion.WriteStruct(entryOffset, &shortDirEntry{
+				Name:       fs.Label,
+				Attributes: uint8(VolumeIDAttr),
+			})
+			if err != nil {
+				return 0, err
+			}
 			entryOffset += DirEntrySize
 		}
 
+		if !isRoot {
+			// Every other directory begins with the "." and ".." entries,
+			// referring to itself and its parent, respectively.
+			err := writeShortEntry(DotName, 0, self, DirectoryAttr, startCluster, 0)
+			if err != nil {
+				return 0, err
+			}
+			err = writeShortEntry(DotDotName, 0, self, DirectoryAttr, parentCluster, 0)
+			if err != nil {
+				return 0, err
+			}
+		}
+
 		// We always visit directories first since that causes all of the
 		// directory tables to be kept together at the start of the filesystem
 		// and thus we maximize locality for path traversal.
@@ -206,92 +984,248 @@ func (fs *Filesystem) Build(region fsutil.Region) {
 		// will be very far away from their directory entries. Might revisit
 		// this strategy later.
 
-		writeLFN := func (entry DirEntryCommon, dosFN []byte) {
-			lfn, err := lfnEncoder.Bytes([]byte(entry.Name))
+		writeLFN := func(entry DirEntryCommon, dosFN [11]byte) error {
+			lfnEntries, err := makeLFNEntries(entry.Name, dosFN)
 			if err != nil {
-				panic(err)
+				return err
 			}
+			for i := range lfnEntries {
+				if err := tableRegion.WriteStruct(entryOffset, &lfnEntries[i]); err != nil {
+					return err
+				}
+				entryOffset += DirEntrySize
+			}
+			return nil
+		}
+
+		shortNames := dir.shortNames()
+		entryIndex := 0
+
+		writeEntry := func(entry DirEntryCommon, attrs Attributes, startCluster uint32, size uint32) error {
+			sn := shortNames[entryIndex]
+			entryIndex += 1
 
-			checksum := byte(0)
-			for _, b := range dosFN {
-				checksum = ((checksum & 1) << 7) + (checksum >> 1) + b
+			if sn.NeedsLFN {
+				if err := writeLFN(entry, sn.Name); err != nil {
+					return err
+				}
 			}
+			return writeShortEntry(sn.Name, sn.CaseFlags, &entry, attrs, startCluster, size)
+		}
 
-			idx := byte(1)
-			for {
-				entryRegion := tableRegion.Slice(entryOffset, DirEntrySize)
-				entryOffset += DirEntrySize
+		// Children of the root directory refer to it as cluster zero
+		// in their ".." entries, regardless of where it really is.
+		childParentCluster := startCluster
+		if isRoot {
+			childParentCluster = 0
+		}
 
-				entryRegion.WriteU8(0x00, idx)
-				idx += 1
+		for _, entry := range dir.Dirs {
+			startCluster, err := writeDirectory(entry.Directory, &entry.DirEntryCommon, childParentCluster)
+			if err != nil {
+				return 0, err
+			}
 
-				entryRegion.WriteU8(0x0b, byte(LFNAttrs))
-				entryRegion.WriteU8(0x0d, checksum)
+			err = writeEntry(
+				entry.DirEntryCommon, entry.Attributes|DirectoryAttr,
+				startCluster, 0,
+			)
+			if err != nil {
+				return 0, err
+			}
+		}
 
-				// Write the padding in and then we'll write the actual
-				// date over the top.
-				entryRegion.WriteBytes(0x01, LFNPadding[0:10])
-				entryRegion.WriteBytes(0x12, LFNPadding[0:12])
-				entryRegion.WriteBytes(0x1c, LFNPadding[0:4])
+		for _, entry := range dir.Files {
+			size := entry.BodyBuilder.Length()
 
-				toCopy := lfn
-				if len(toCopy) > 10 {
-					toCopy = toCopy[:10]
-				}
-				copied := entryRegion.WriteBytes(0x01, toCopy)
-				if copied < 10 {
-					entryRegion.WriteU16LE(0x01 + copied, 0)
-					break
+			// Empty files have no clusters at all, and are recorded as
+			// starting at cluster zero.
+			startCluster := uint32(0)
+			if size > 0 {
+				clusters, err := allocChain(divCeil(uint32(size), layout.ClusterSize))
+				if err != nil {
+					return 0, err
 				}
-				lfn = lfn[10:]
+				startCluster = uint32(clusters[0])
 
-				toCopy = lfn
-				if len(toCopy) > 12 {
-					toCopy = toCopy[:12]
+				// File bodies also get consecutive clusters.
+				err = data.body(clusterOffset(clusters[0]), entry.BodyBuilder)
+				if err != nil {
+					return 0, fmt.Errorf("failed to build %s: %w", entry.Name, err)
 				}
-				copied = entryRegion.WriteBytes(0x0e, toCopy)
-				if copied < 12 {
-					entryRegion.WriteU16LE(0x0e + copied, 0)
-					break
-				}
-				lfn = lfn[12:]
+			}
 
-				toCopy = lfn
-				if len(toCopy) > 4 {
-					toCopy = toCopy[:4]
-				}
-				copied = entryRegion.WriteBytes(0x1c, toCopy)
-				if copied < 4 {
-					entryRegion.WriteU16LE(0x1c + copied, 0)
-					break
-				}
-				lfn = lfn[4:]
+			err := writeEntry(
+				entry.DirEntryCommon, entry.Attributes&^DirectoryAttr,
+				startCluster, uint32(size),
+			)
+			if err != nil {
+				return 0, err
 			}
 		}
 
-		for _, entry := range dir.Dirs {
-			startCluster := writeDirectory(entry.Directory, false)
+		return startCluster, nil
+	}
 
-			// For now we just use junk short filenames, since no reasonable
-			// OS looks at these anymore anyway.
-			dosFN := []byte(fmt.Sprintf("%08xLFN", startCluster))
+	// Always start with the root directory
+	rootDirCluster, err := writeDirectory(fs.RootDir, nil, 0)
+	if err != nil {
+		return err
+	}
+	if used := nextCluster - 2; used != layout.UsedClusters {
+		// ZeroRanges assumes that everything after the used clusters is
+		// free, so we can't produce an image that disagrees with it.
+		return fmt.Errorf("filesystem content used %d clusters, but %d were expected", used, layout.UsedClusters)
+	}
+	if fatType == FAT32 {
+		bootRecord.WriteU32LE(0x02c, rootDirCluster)
 
-			writeLFN(entry.DirEntryCommon, dosFN)
-			entryRegion := tableRegion.Slice(entryOffset, DirEntrySize)
-			entryOffset += DirEntrySize
+		// We allocate clusters in order, so all of those from nextCluster
+		// onwards are free.
+		var info fsInfoSectorFields
+		if err := fsInfo.ReadStruct(0, &info); err != nil {
+			return err
+		}
+		info.FreeClusterCount = layout.DataClusters + 2 - nextCluster
+		info.NextFreeCluster = nextCluster
+		if info.FreeClusterCount == 0 {
+			info.NextFreeCluster = 0xffffffff
+		}
+		if err := fsInfo.WriteStruct(0, &info); err != nil {
+			return err
+		}
+	}
+
+	// The additional FATs are identical copies of the first.
+	fatBytes := fat.Bytes()
+	for i := uint32(1); i < layout.FATCount; i++ {
+		fatStart := layout.ReservedSectors + i*layout.FATSectors
+		region.WriteBytes(int(fatStart*sectorSize), fatBytes)
+	}
+
+	if fs.BackupBootSector != 0 && fatType == FAT32 {
+		backupStart := int(fs.BackupBootSector * sectorSize)
+		region.WriteBytes(backupStart, bootRecord.Bytes())
+		region.WriteBytes(backupStart+int(sectorSize), fsInfo.Bytes())
+	}
 
-			entryRegion.WriteBytes(0x00, dosFN)
-			entryRegion.WriteU8(0x0b, byte(entry.Attributes | DirectoryAttr))
-			entryRegion.WriteU16LE(0x14, uint16(startCluster >> 16))
-			entryRegion.WriteU16LE(0x1a, uint16(startCluster))
+	return nil
+}
+
+// makeLFNEntries returns the long filename entries for the given name,
+// belonging to the entry with the given short name, in the order they are
+// stored in the directory table.
+func makeLFNEntries(name string, dosFN [11]byte) ([]lfnDirEntry, error) {
+	lfnEncoding := unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM)
+	lfn, err := lfnEncoding.NewEncoder().Bytes([]byte(name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode long filename for %s: %w", name, err)
+	}
+
+	checksum := shortNameChecksum(dosFN[:])
+
+	// Each LFN entry holds 13 UCS-2 characters. The name is
+	// null-terminated unless it exactly fills the final entry,
+	// and any remaining space is filled with padding.
+	count := (len(lfn) + lfnEntryBytes - 1) / lfnEntryBytes
+	chars := make([]byte, count*lfnEntryBytes)
+	copy(chars, lfn)
+	if len(lfn) < len(chars) {
+		copy(chars[len(lfn)+2:], LFNPadding)
+	}
+
+	// The entries are stored in reverse order, so that the one
+	// holding the start of the name immediately precedes the
+	// short filename entry. The first entry in the table is
+	// flagged as the last logical entry.
+	ret := make([]lfnDirEntry, 0, count)
+	for i := count; i > 0; i-- {
+		lfnEntry := lfnDirEntry{
+			Sequence:   byte(i),
+			Attributes: uint8(LFNAttrs),
+			Checksum:   checksum,
 		}
+		if i == count {
+			lfnEntry.Sequence |= lfnLastEntryFlag
+		}
+		lfnEntry.setChars(chars[(i-1)*lfnEntryBytes : i*lfnEntryBytes])
+		ret = append(ret, lfnEntry)
+	}
+	return ret, nil
+}
+
+// A dataArea is where build places directory tables and file bodies. The
+// offsets given are relative to the start of the data area, and each table
+// or body is given a consecutive run of clusters.
+type dataArea interface {
+	// table returns a region for a directory table of the given length.
+	table(offset, length int) fsutil.Region
 
-		return startCluster
+	// body arranges for a file body to be built at the given offset.
+	body(offset int, builder fsutil.RegionBuilder) error
+}
+
+// regionDataArea writes directly into the data area of a region covering
+// the whole filesystem.
+type regionDataArea struct {
+	region *fsutil.IndexedRegion
+}
+
+func (a *regionDataArea) table(offset, length int) fsutil.Region {
+	return a.region.Slice(offset, length)
+}
+
+func (a *regionDataArea) body(offset int, builder fsutil.RegionBuilder) error {
+	return builder.Build(a.region.Slice(offset, builder.Length()))
+}
+
+// rangeDataArea collects the parts of the data area for building in
+// separate ranges. Because clusters are allocated in order, the parts are
+// also collected in order.
+type rangeDataArea struct {
+	start int
+	parts fsutil.RangeParts
+}
+
+func (a *rangeDataArea) table(offset, length int) fsutil.Region {
+	buf := make([]byte, length)
+	a.parts = append(a.parts, fsutil.RangePart{
+		Offset:  a.start + offset,
+		Length:  length,
+		Builder: &fsutil.BufferRegionBuilder{Buffer: buf},
+	})
+	return fsutil.RegionForBytes(buf)
+}
+
+func (a *rangeDataArea) body(offset int, builder fsutil.RegionBuilder) error {
+	ranges, err := fsutil.PrepareRanges(builder)
+	if err != nil {
+		return err
 	}
+	a.parts = append(a.parts, fsutil.RangePart{
+		Offset:  a.start + offset,
+		Length:  builder.Length(),
+		Builder: ranges,
+	})
+	return nil
+}
 
-	// Always start with the root directory
-	rootDirCluster := writeDirectory(fs.RootDir, true)
-	bootRecord.WriteU32LE(0x02c, rootDirCluster)
+// dosTime holds the fields used to record a timestamp in a directory entry.
+type dosTime struct {
+	date      uint16
+	tod       uint16
+	tenMillis uint8
+}
+
+// encodeTime converts a timestamp for the entry with the given name into
+// the fields used in directory entries, taking into account the
+// filesystem's time zone and handling of out-of-range times.
+func (fs *Filesystem) encodeTime(name string, t time.Time) (dosTime, error) {
+	date, tod, tenMillis, inRange := encodeDOSTime(t, fs.Location)
+	if !inRange && fs.StrictTimes {
+		return dosTime{}, &TimeRangeError{Name: name, Time: t}
+	}
+	return dosTime{date, tod, tenMillis}, nil
 }
 
 func divCeil(a uint32, b uint32) uint32 {
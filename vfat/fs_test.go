@@ -0,0 +1,511 @@
+package vfat
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/apparentlymart/go-fsutil/fsutil"
+)
+
+func TestBuildGeometry(t *testing.T) {
+	fs := &Filesystem{
+		SectorSize:      4096,
+		ClusterSize:     32768,
+		FATCount:        2,
+		ReservedSectors: 32,
+		RootDir: &Directory{
+			Files: []DirEntryFile{
+				{
+					DirEntryCommon: DirEntryCommon{Name: "big.bin"},
+					BodyBuilder: &fsutil.BufferRegionBuilder{
+						Buffer: bytes.Repeat([]byte{0xa5}, 100000),
+					},
+				},
+			},
+		},
+	}
+
+	region := fsutil.RegionForBytes(make([]byte, fs.Length()))
+	if err := fs.Build(region); err != nil {
+		t.Fatalf("failed to build image: %s", err)
+	}
+	img, err := Open(region)
+	if err != nil {
+		t.Fatalf("failed to open image: %s", err)
+	}
+
+	if got, want := img.BytesPerSector, uint32(4096); got != want {
+		t.Errorf("sector size is %d; want %d", got, want)
+	}
+	if got, want := img.SectorsPerCluster, uint32(8); got != want {
+		t.Errorf("sectors per cluster is %d; want %d", got, want)
+	}
+	if got, want := img.FATCount, uint32(2); got != want {
+		t.Errorf("FAT count is %d; want %d", got, want)
+	}
+	if img.ReservedSectors < 32 {
+		t.Errorf("reserved sector count is %d; want at least 32", img.ReservedSectors)
+	}
+	rootSectors := divCeil(img.RootEntryCount*DirEntrySize, img.BytesPerSector)
+	dataStart := (img.ReservedSectors + img.FATCount*img.SectorsPerFAT + rootSectors) * img.BytesPerSector
+	if dataStart%32768 != 0 {
+		t.Errorf("data area starts at %d, which is not cluster-aligned", dataStart)
+	}
+
+	fatLen := int(img.SectorsPerFAT * img.BytesPerSector)
+	fat1 := region.Slice(int(img.ReservedSectors*img.BytesPerSector), fatLen).Bytes()
+	fat2 := region.Slice(int(img.ReservedSectors*img.BytesPerSector)+fatLen, fatLen).Bytes()
+	if !bytes.Equal(fat1, fat2) {
+		t.Errorf("second FAT differs from the first")
+	}
+
+	entry, err := img.Lookup("big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := img.FileRegion(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body.Bytes(), bytes.Repeat([]byte{0xa5}, 100000)) {
+		t.Errorf("big.bin has the wrong contents")
+	}
+}
+
+func TestBuildFATTypes(t *testing.T) {
+	body := bytes.Repeat([]byte("fat"), 1000)
+
+	for _, fatType := range []FATType{FAT12, FAT16, FAT32} {
+		fs := &Filesystem{
+			ClusterSize:      512,
+			FATType:          fatType,
+			FATCount:         2,
+			ReservedSectors:  8,
+			BackupBootSector: 6,
+			RootDir: &Directory{
+				Dirs: []DirEntryDir{
+					{
+						DirEntryCommon: DirEntryCommon{Name: "dir"},
+						Directory: &Directory{
+							Files: []DirEntryFile{
+								{
+									DirEntryCommon: DirEntryCommon{Name: "body.txt"},
+									BodyBuilder:    &fsutil.BufferRegionBuilder{Buffer: body},
+								},
+							},
+						},
+					},
+				},
+			},
+		}
+
+		region := fsutil.RegionForBytes(make([]byte, fs.Length()))
+		if err := fs.Build(region); err != nil {
+			t.Errorf("failed to build %s image: %s", fatType, err)
+			continue
+		}
+		img, err := Open(region)
+		if err != nil {
+			t.Errorf("failed to open %s image: %s", fatType, err)
+			continue
+		}
+
+		if img.FATType != fatType {
+			t.Errorf("%s image is detected as %s", fatType, img.FATType)
+		}
+		entry, err := img.Lookup("dir/body.txt")
+		if err != nil {
+			t.Errorf("failed to find body.txt in %s image: %s", fatType, err)
+			continue
+		}
+		got, err := img.FileRegion(entry)
+		if err != nil {
+			t.Errorf("failed to read body.txt in %s image: %s", fatType, err)
+			continue
+		}
+		if !bytes.Equal(got.Bytes(), body) {
+			t.Errorf("body.txt in %s image has the wrong contents", fatType)
+		}
+
+		fatLen := int(img.SectorsPerFAT * img.BytesPerSector)
+		fat1 := region.Slice(int(img.ReservedSectors*img.BytesPerSector), fatLen).Bytes()
+		fat2 := region.Slice(int(img.ReservedSectors*img.BytesPerSector)+fatLen, fatLen).Bytes()
+		if !bytes.Equal(fat1, fat2) {
+			t.Errorf("second FAT in %s image differs from the first", fatType)
+		}
+
+		if fatType == FAT32 {
+			primary := region.Slice(0, 2*512).Bytes()
+			backup := region.Slice(6*512, 2*512).Bytes()
+			if !bytes.Equal(primary, backup) {
+				t.Errorf("backup boot record and FSInfo differ from the primary")
+			}
+		}
+	}
+}
+
+func TestFAT12Entries(t *testing.T) {
+	fat := fsutil.RegionForBytes(make([]byte, 6))
+	FAT12.writeEntry(fat, 0, 0xabc)
+	FAT12.writeEntry(fat, 1, 0x123)
+	FAT12.writeEntry(fat, 3, 0xfff)
+	FAT12.writeEntry(fat, 2, 0x456)
+
+	want := []byte{0xbc, 0x3a, 0x12, 0x56, 0xf4, 0xff}
+	if got := fat.Bytes(); !bytes.Equal(got, want) {
+		t.Errorf("FAT contains % x; want % x", got, want)
+	}
+	for cluster, want := range []uint32{0xabc, 0x123, 0x456, 0xfff} {
+		if got := FAT12.readEntry(fat, uint32(cluster)); got != want {
+			t.Errorf("entry %d is 0x%03x; want 0x%03x", cluster, got, want)
+		}
+	}
+}
+
+func TestBuildErrors(t *testing.T) {
+	vfs := &Filesystem{
+		RootDir: &Directory{
+			Files: []DirEntryFile{
+				{
+					DirEntryCommon: DirEntryCommon{Name: "missing.txt"},
+					BodyBuilder: &fsFileRegionBuilder{
+						fsys: fstest.MapFS{},
+						name: "missing.txt",
+						size: 10,
+					},
+				},
+			},
+		},
+	}
+
+	err := vfs.Build(fsutil.RegionForBytes(make([]byte, vfs.Length())))
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("error is %#v; want fs.ErrNotExist", err)
+	}
+
+	err = vfs.Build(fsutil.RegionForBytes(make([]byte, 512)))
+	if _, ok := err.(*fsutil.OutOfBoundsError); !ok {
+		t.Errorf("error for short region is %#v; want *fsutil.OutOfBoundsError", err)
+	}
+
+	vfs = &Filesystem{SectorSize: 500, RootDir: &Directory{}}
+	if got := vfs.Length(); got != 0 {
+		t.Errorf("invalid filesystem has length %d; want 0", got)
+	}
+	if err := vfs.Build(fsutil.Region{}); err == nil {
+		t.Errorf("succeeded in building invalid filesystem; want error")
+	}
+}
+
+func TestBuildInvalidNames(t *testing.T) {
+	file := func(name string) DirEntryFile {
+		return DirEntryFile{
+			DirEntryCommon: DirEntryCommon{Name: name},
+			BodyBuilder:    &fsutil.BufferRegionBuilder{},
+		}
+	}
+	dir := func(name string, files ...DirEntryFile) DirEntryDir {
+		return DirEntryDir{
+			DirEntryCommon: DirEntryCommon{Name: name},
+			Directory:      &Directory{Files: files},
+		}
+	}
+
+	tests := []*Directory{
+		{Files: []DirEntryFile{file("")}},
+		{Files: []DirEntryFile{file("..")}},
+		{Files: []DirEntryFile{file("a:b.txt")}},
+		{Files: []DirEntryFile{file(strings.Repeat("a", 256))}},
+		{Files: []DirEntryFile{file("a.txt"), file("a.txt")}},
+		{Files: []DirEntryFile{file("a.txt"), file("A.TXT")}},
+		{Dirs: []DirEntryDir{dir("Boot")}, Files: []DirEntryFile{file("BOOT")}},
+		{Dirs: []DirEntryDir{dir("boot", file("x.txt"), file("X.txt"))}},
+	}
+	for i, rootDir := range tests {
+		vfs := &Filesystem{RootDir: rootDir}
+		if got := vfs.Length(); got != 0 {
+			t.Errorf("test %d: filesystem has length %d; want 0", i, got)
+		}
+		if err := vfs.Build(fsutil.RegionForBytes(make([]byte, 1<<20))); err == nil {
+			t.Errorf("test %d: succeeded; want error", i)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []*Filesystem{
+		{SectorSize: 500, RootDir: &Directory{}},
+		{ClusterSize: 6144, RootDir: &Directory{}},
+		{SectorSize: 4096, ClusterSize: 2048, RootDir: &Directory{}},
+		{FATCount: 256, RootDir: &Directory{}},
+		{BackupBootSector: 1, ReservedSectors: 32, RootDir: &Directory{}},
+		{BackupBootSector: 6, RootDir: &Directory{}},
+		{TotalSize: 1000000, RootDir: &Directory{}},
+		{TotalSize: 1 << 20, ExtraClusterCount: 1, RootDir: &Directory{}},
+		{},
+	}
+
+	for _, fs := range tests {
+		if err := fs.Validate(); err == nil {
+			t.Errorf("%#v is valid; want error", fs)
+		}
+	}
+
+	if err := (&Filesystem{RootDir: &Directory{}}).Validate(); err != nil {
+		t.Errorf("default filesystem is invalid: %s", err)
+	}
+}
+
+func TestBuildTo(t *testing.T) {
+	src := fstest.MapFS{
+		"big.bin":          {Data: bytes.Repeat([]byte("0123456789abcdef"), 200000)},
+		"sub/small.txt":    {Data: []byte("small")},
+		"sub/deep/mid.bin": {Data: bytes.Repeat([]byte{0x5a}, 70000)},
+	}
+	for _, fatType := range []FATType{FAT16, FAT32} {
+		dir, err := DirectoryFromFS(src, ".")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dir.Files = append(dir.Files, DirEntryFile{
+			DirEntryCommon: DirEntryCommon{Name: "buffered.txt"},
+			BodyBuilder:    &fsutil.BufferRegionBuilder{Buffer: []byte("buffered")},
+		})
+		fs := &Filesystem{
+			FATType:           fatType,
+			ExtraClusterCount: 10,
+			RootDir:           dir,
+		}
+
+		want := make([]byte, fs.Length())
+		if err := fs.Build(fsutil.RegionForBytes(want)); err != nil {
+			t.Fatalf("failed to build %s filesystem: %s", fatType, err)
+		}
+
+		var buf bytes.Buffer
+		if _, err := fsutil.BuildTo(&buf, fs); err != nil {
+			t.Fatalf("failed to stream %s filesystem: %s", fatType, err)
+		}
+		if !bytes.Equal(buf.Bytes(), want) {
+			t.Errorf("streamed %s filesystem differs from built filesystem", fatType)
+		}
+	}
+}
+
+func TestBuildSparse(t *testing.T) {
+	src := fstest.MapFS{
+		"a.txt":         {Data: bytes.Repeat([]byte("a"), 5000)},
+		"sub/b.txt":     {Data: []byte("b")},
+		"sub/c/d.txt":   {Data: bytes.Repeat([]byte("d"), 70000)},
+		"sub/c/e/f.txt": {Data: []byte("f")},
+	}
+	for _, fatType := range []FATType{FAT12, FAT16, FAT32} {
+		dir, err := DirectoryFromFS(src, ".")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fs := &Filesystem{
+			FATType:     fatType,
+			ClusterSize: 512,
+			RootDir:     dir,
+		}
+		// Leave plenty of free space, within what the FAT type allows.
+		_, maxClusters := fatType.clusterRange()
+		fs.ExtraClusterCount = maxClusters / 2
+		if fatType == FAT32 {
+			fs.ExtraClusterCount = 100000
+		}
+
+		want := make([]byte, fs.Length())
+		if err := fs.Build(fsutil.RegionForBytes(want)); err != nil {
+			t.Fatalf("failed to build %s filesystem: %s", fatType, err)
+		}
+
+		zeros := fsutil.ZeroRanges(fs)
+		if len(zeros) == 0 {
+			t.Errorf("%s filesystem has no zero ranges", fatType)
+		}
+		for _, r := range zeros {
+			if r.Offset+r.Length > len(want) {
+				t.Errorf("%s zero range %#v is outside of the filesystem", fatType, r)
+				continue
+			}
+			for i, b := range want[r.Offset : r.Offset+r.Length] {
+				if b != 0 {
+					t.Errorf("%s zero range %#v has non-zero byte at %d", fatType, r, r.Offset+i)
+					break
+				}
+			}
+		}
+
+		fn := filepath.Join(t.TempDir(), "fs.img")
+		if err := fsutil.BuildFile(fn, fs); err != nil {
+			t.Fatalf("failed to build %s file: %s", fatType, err)
+		}
+		got, err := os.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s file differs from built filesystem", fatType)
+		}
+	}
+}
+
+func TestBuildTotalSize(t *testing.T) {
+	src := fstest.MapFS{
+		"a.txt":     {Data: bytes.Repeat([]byte("a"), 5000)},
+		"sub/b.txt": {Data: []byte("b")},
+	}
+	tests := []struct {
+		totalSize   uint64
+		fatType     FATType
+		clusterSize uint32
+		wantType    FATType
+		wantCluster uint32
+	}{
+		{1 << 20, AutoFATType, 0, FAT12, 4096},
+		{1<<20 + 512, AutoFATType, 0, FAT12, 4096},
+		{32 << 20, AutoFATType, 0, FAT16, 4096},
+		{32 << 20, FAT16, 2048, FAT16, 2048},
+		{8 << 20, FAT16, 0, FAT16, 1024},
+		{256 << 20, FAT32, 0, FAT32, 2048},
+		{1 << 30, AutoFATType, 0, FAT32, 4096},
+	}
+	for _, test := range tests {
+		dir, err := DirectoryFromFS(src, ".")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fs := &Filesystem{
+			TotalSize:   test.totalSize,
+			FATType:     test.fatType,
+			ClusterSize: test.clusterSize,
+			FATCount:    2,
+			RootDir:     dir,
+		}
+		if got, want := fs.Length(), int(test.totalSize); got != want {
+			t.Errorf("%d-byte %s filesystem has length %d", want, test.fatType, got)
+			continue
+		}
+
+		fn := filepath.Join(t.TempDir(), "fs.img")
+		if err := fsutil.BuildFile(fn, fs); err != nil {
+			t.Errorf("failed to build %d-byte %s filesystem: %s", test.totalSize, test.fatType, err)
+			continue
+		}
+		f, err := fsutil.OpenFile(fn, fsutil.ReadOnly)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := Open(f.Region)
+		if err != nil {
+			f.Close()
+			t.Errorf("failed to open %d-byte %s filesystem: %s", test.totalSize, test.fatType, err)
+			continue
+		}
+
+		if img.FATType != test.wantType {
+			t.Errorf("%d-byte %s filesystem is %s; want %s", test.totalSize, test.fatType, img.FATType, test.wantType)
+		}
+		if got := img.SectorsPerCluster * img.BytesPerSector; got != test.wantCluster {
+			t.Errorf("%d-byte %s filesystem has %d-byte clusters; want %d", test.totalSize, test.fatType, got, test.wantCluster)
+		}
+		if got := uint64(img.TotalSectors) * uint64(img.BytesPerSector); got != test.totalSize {
+			t.Errorf("%d-byte %s filesystem records %d bytes", test.totalSize, test.fatType, got)
+		}
+		if got := img.VerifyFSInfo(); got != nil {
+			t.Errorf("%d-byte %s filesystem has FSInfo discrepancies %v", test.totalSize, test.fatType, got)
+		}
+		entry, err := img.Lookup("sub/b.txt")
+		if err != nil {
+			t.Errorf("failed to find b.txt in %d-byte %s filesystem: %s", test.totalSize, test.fatType, err)
+		} else if body, err := img.FileRegion(entry); err != nil || string(body.Bytes()) != "b" {
+			t.Errorf("b.txt in %d-byte %s filesystem has the wrong contents", test.totalSize, test.fatType)
+		}
+		f.Close()
+	}
+}
+
+func TestBuildTotalSizeErrors(t *testing.T) {
+	big := &Directory{
+		Files: []DirEntryFile{
+			{
+				DirEntryCommon: DirEntryCommon{Name: "big.bin"},
+				BodyBuilder:    &fsutil.BufferRegionBuilder{Buffer: make([]byte, 2<<20)},
+			},
+		},
+	}
+	tests := []*Filesystem{
+		{TotalSize: 1 << 20, RootDir: big},
+		{TotalSize: 1 << 20, FATType: FAT32, RootDir: &Directory{}},
+		{TotalSize: 4096, RootDir: &Directory{}},
+	}
+	for _, fs := range tests {
+		if _, err := fs.calcLayout(); err == nil {
+			t.Errorf("succeeded in laying out %d-byte %s filesystem; want error", fs.TotalSize, fs.FATType)
+		}
+		if got := fs.Length(); got != 0 {
+			t.Errorf("%d-byte %s filesystem that can't be built has length %d; want 0", fs.TotalSize, fs.FATType, got)
+		}
+	}
+}
+
+func TestLayoutBoundaries(t *testing.T) {
+	// calcLayout checks every layout it returns, so here we only need to
+	// try the sizes most likely to expose mistakes: those either side of
+	// the limits of each FAT type, for each cluster size.
+	for clusterSize := uint32(512); clusterSize <= 65536; clusterSize *= 2 {
+		for _, limit := range []uint32{maxFAT12Clusters, maxFAT16Clusters} {
+			for extra := limit - 3; extra <= limit+3; extra++ {
+				fs := &Filesystem{
+					ClusterSize:       clusterSize,
+					ExtraClusterCount: extra,
+					RootDir:           &Directory{},
+				}
+				if _, err := fs.calcLayout(); err != nil {
+					t.Errorf("failed to lay out %d clusters of %d bytes: %s", extra, clusterSize, err)
+				}
+
+				fs.ExtraClusterCount = 0
+				fs.TotalSize = uint64(extra) * uint64(clusterSize)
+				if _, err := fs.calcLayout(); err != nil {
+					t.Errorf("failed to lay out %d-byte filesystem with %d-byte clusters: %s", fs.TotalSize, clusterSize, err)
+				}
+			}
+		}
+	}
+}
+
+func TestMakeLabel(t *testing.T) {
+	tests := map[string]string{
+		"":             "",
+		"boot":         "BOOT       ",
+		"My Disk":      "MY DISK    ",
+		"ELEVENCHARS":  "ELEVENCHARS",
+		"v1.0":         "!",
+		"twelve chars": "!",
+		"naïve":        "!",
+	}
+	for input, want := range tests {
+		got, err := MakeLabel(input)
+		switch {
+		case want == "!":
+			if err == nil {
+				t.Errorf("label %q is valid; want error", input)
+			}
+		case err != nil:
+			t.Errorf("label %q is invalid: %s", input, err)
+		case want == "" && got != noLabel:
+			t.Errorf("label %q is %q; want no label", input, got)
+		case want != "" && string(got[:]) != want:
+			t.Errorf("label %q is %q; want %q", input, got, want)
+		}
+	}
+}
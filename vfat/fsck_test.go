@@ -0,0 +1,471 @@
+package vfat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/apparentlymart/go-fsutil/fsutil"
+)
+
+// FuzzBuild builds filesystems from random directory trees and checks each
+// one with fsck, which reads the image independently of Open so that the
+// builder and the reader can't share a misunderstanding of the format.
+func FuzzBuild(f *testing.F) {
+	for seed := int64(0); seed < 48; seed++ {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, seed int64) {
+		r := rand.New(rand.NewSource(seed))
+
+		fs := &Filesystem{
+			FATType:  []FATType{AutoFATType, FAT12, FAT16, FAT32}[r.Intn(4)],
+			FATCount: uint32(1 + r.Intn(2)),
+		}
+		fs.ClusterSize = 512 << r.Intn(5)
+		if fs.FATType == FAT32 {
+			// FAT32 needs at least 65525 clusters, so we keep them small
+			// to keep the image small.
+			fs.ClusterSize = 512
+		}
+		if r.Intn(2) == 0 {
+			fs.ExtraClusterCount = uint32(r.Intn(50))
+		}
+
+		want := make(map[string][]byte)
+		fs.RootDir = randomDirectory(r, "", 3, int(fs.ClusterSize), want)
+
+		if r.Intn(4) == 0 {
+			// Leaving some room beyond what the content needs should give
+			// the target-size mode no trouble fitting the same content.
+			fs.TotalSize = uint64(fs.Length()) + uint64(512*r.Intn(64))
+			fs.ExtraClusterCount = 0
+		}
+
+		length := fs.Length()
+		if length == 0 {
+			_, err := fs.calcLayout()
+			t.Fatalf("failed to lay out filesystem: %s", err)
+		}
+		img := make([]byte, length)
+		if err := fs.Build(fsutil.RegionForBytes(img)); err != nil {
+			t.Fatalf("failed to build filesystem: %s", err)
+		}
+
+		got, err := fsck(img)
+		if err != nil {
+			t.Fatalf("invalid filesystem: %s", err)
+		}
+		if fs.FATType != AutoFATType && got.fatType != fs.FATType {
+			t.Errorf("filesystem is %s; want %s", got.fatType, fs.FATType)
+		}
+		if got.clusterSize != int(fs.ClusterSize) {
+			t.Errorf("filesystem has %d-byte clusters; want %d", got.clusterSize, fs.ClusterSize)
+		}
+		if fs.TotalSize == 0 && got.freeClusters < int(fs.ExtraClusterCount) {
+			t.Errorf("filesystem has %d free clusters; want at least %d", got.freeClusters, fs.ExtraClusterCount)
+		}
+
+		for name, body := range want {
+			gotBody, ok := got.files[name]
+			if !ok {
+				t.Errorf("filesystem has no %q", name)
+				continue
+			}
+			if !bytes.Equal(gotBody, body) {
+				t.Errorf("%q has the wrong contents", name)
+			}
+		}
+		for name := range got.files {
+			if _, ok := want[name]; !ok {
+				t.Errorf("filesystem has unexpected %q", name)
+			}
+		}
+	})
+}
+
+// randomDirectory generates a directory tree, recording in want the
+// contents of each file and a nil entry for each directory, by path.
+func randomDirectory(r *rand.Rand, path string, depth int, clusterSize int, want map[string][]byte) *Directory {
+	dir := &Directory{}
+	taken := make(map[string]bool)
+	uniqueName := func() string {
+		for {
+			name := randomName(r)
+			if !taken[strings.ToUpper(name)] {
+				taken[strings.ToUpper(name)] = true
+				return name
+			}
+		}
+	}
+
+	if depth > 0 {
+		for i := r.Intn(4); i > 0; i-- {
+			name := uniqueName()
+			want[path+name] = nil
+			dir.Dirs = append(dir.Dirs, DirEntryDir{
+				DirEntryCommon: DirEntryCommon{Name: name},
+				Directory:      randomDirectory(r, path+name+"/", depth-1, clusterSize, want),
+			})
+		}
+	}
+
+	// Some directories get enough entries to need several clusters for
+	// their tables.
+	fileCount := r.Intn(6)
+	if r.Intn(8) == 0 {
+		fileCount += 40
+	}
+	for i := 0; i < fileCount; i++ {
+		name := uniqueName()
+		sizes := []int{0, 1, clusterSize - 1, clusterSize, clusterSize + 1, 2 * clusterSize, r.Intn(3 * clusterSize)}
+		body := make([]byte, sizes[r.Intn(len(sizes))])
+		r.Read(body)
+		want[path+name] = body
+		dir.Files = append(dir.Files, DirEntryFile{
+			DirEntryCommon: DirEntryCommon{Name: name},
+			BodyBuilder:    &fsutil.BufferRegionBuilder{Buffer: body},
+		})
+	}
+	return dir
+}
+
+func randomName(r *rand.Rand) string {
+	n := r.Intn(1000)
+	switch r.Intn(7) {
+	case 0:
+		return fmt.Sprintf("FILE%d.TXT", n)
+	case 1:
+		return fmt.Sprintf("file%d.txt", n)
+	case 2:
+		return fmt.Sprintf("Mixed Case %d.Name", n)
+	case 3:
+		// Names of exactly 13 and 26 characters fill their last long
+		// file name entry completely, with no terminator.
+		return fmt.Sprintf("%013d", n)
+	case 4:
+		return fmt.Sprintf("%026d", n)
+	case 5:
+		return fmt.Sprintf("naïve café %d.tar.gz", n)
+	default:
+		return strings.Repeat("long name ", 1+r.Intn(20)) + fmt.Sprint(n)
+	}
+}
+
+type fsckResult struct {
+	fatType      FATType
+	clusterSize  int
+	freeClusters int
+
+	// files maps the path of each file to its contents, and the path of
+	// each directory to nil.
+	files map[string][]byte
+}
+
+// fsck checks the consistency of a FAT filesystem image, following the
+// FAT specification directly rather than reusing any of this package's
+// reading code.
+//
+// Along with basic validity, it requires that the image has the exact
+// length its boot sector declares, that no cluster belongs to more than
+// one chain or to none, that every chain is exactly as long as its content
+// requires, and that every long file name is complete.
+func fsck(img []byte) (*fsckResult, error) {
+	if len(img) < 512 {
+		return nil, fmt.Errorf("image is only %d bytes", len(img))
+	}
+	u8 := func(b []byte, off int) int { return int(b[off]) }
+	u16 := func(b []byte, off int) int { return int(binary.LittleEndian.Uint16(b[off:])) }
+	u32 := func(b []byte, off int) int { return int(binary.LittleEndian.Uint32(b[off:])) }
+
+	bps := u16(img, 0x0b)
+	spc := u8(img, 0x0d)
+	reserved := u16(img, 0x0e)
+	fatCount := u8(img, 0x10)
+	rootEntries := u16(img, 0x11)
+	totalSectors := u16(img, 0x13)
+	if totalSectors == 0 {
+		totalSectors = u32(img, 0x20)
+	}
+	fatSectors := u16(img, 0x16)
+	if fatSectors == 0 {
+		fatSectors = u32(img, 0x24)
+	}
+	if u16(img, 0x1fe) != 0xaa55 {
+		return nil, fmt.Errorf("boot sector has no signature")
+	}
+	if bps < 512 || bps&(bps-1) != 0 || spc == 0 || spc&(spc-1) != 0 || reserved == 0 || fatCount == 0 {
+		return nil, fmt.Errorf("invalid BPB")
+	}
+	if len(img) != totalSectors*bps {
+		return nil, fmt.Errorf("image is %d bytes, but the BPB declares %d", len(img), totalSectors*bps)
+	}
+
+	rootSectors := (rootEntries*32 + bps - 1) / bps
+	dataStart := reserved + fatCount*fatSectors + rootSectors
+	if dataStart >= totalSectors {
+		return nil, fmt.Errorf("data area starts at sector %d, beyond the end of the image", dataStart)
+	}
+	clusterCount := (totalSectors - dataStart) / spc
+	clusterSize := spc * bps
+
+	ret := &fsckResult{clusterSize: clusterSize, files: make(map[string][]byte)}
+	var eoc int
+	switch {
+	case clusterCount < 4085:
+		ret.fatType, eoc = FAT12, 0xff8
+	case clusterCount < 65525:
+		ret.fatType, eoc = FAT16, 0xfff8
+	default:
+		ret.fatType, eoc = FAT32, 0x0ffffff8
+	}
+	if (ret.fatType == FAT32) != (rootEntries == 0) {
+		return nil, fmt.Errorf("%s filesystem has %d root entries", ret.fatType, rootEntries)
+	}
+
+	fat := img[reserved*bps : (reserved+fatSectors)*bps]
+	for i := 1; i < fatCount; i++ {
+		start := (reserved + i*fatSectors) * bps
+		if !bytes.Equal(img[start:start+fatSectors*bps], fat) {
+			return nil, fmt.Errorf("FAT %d differs from FAT 0", i)
+		}
+	}
+	entry := func(cluster int) int {
+		switch ret.fatType {
+		case FAT12:
+			v := u16(fat, cluster+cluster/2)
+			if cluster%2 == 1 {
+				return v >> 4
+			}
+			return v & 0xfff
+		case FAT16:
+			return u16(fat, cluster*2)
+		default:
+			return u32(fat, cluster*4) & 0x0fffffff
+		}
+	}
+	if (clusterCount+2)*int(ret.fatType) > len(fat)*8 {
+		return nil, fmt.Errorf("FAT is too small for %d clusters", clusterCount)
+	}
+
+	owner := make(map[int]string)
+	chain := func(first int, name string) ([]byte, int, error) {
+		var data []byte
+		length := 0
+		for cluster := first; cluster < eoc; cluster = entry(cluster) {
+			if cluster < 2 || cluster >= clusterCount+2 {
+				return nil, 0, fmt.Errorf("%s refers to invalid cluster %d", name, cluster)
+			}
+			if other, ok := owner[cluster]; ok {
+				return nil, 0, fmt.Errorf("%s and %s both use cluster %d", name, other, cluster)
+			}
+			owner[cluster] = name
+			start := (dataStart + (cluster-2)*spc) * bps
+			data = append(data, img[start:start+clusterSize]...)
+			length++
+		}
+		return data, length, nil
+	}
+
+	var checkDir func(table []byte, path string, self, parent int) error
+	checkDir = func(table []byte, path string, self, parent int) error {
+		isRoot := path == ""
+		var lfn []uint16
+		lfnNext, lfnSum := 0, 0
+		used := 0
+		for off := 0; off < len(table); off += 32 {
+			e := table[off : off+32]
+			if e[0] == 0 {
+				break
+			}
+			used++
+			if e[0] == 0xe5 {
+				return fmt.Errorf("directory %q has a deleted entry", path)
+			}
+			attrs := u8(e, 0x0b)
+
+			if attrs == 0x0f {
+				ord := int(e[0])
+				if ord&0x40 != 0 {
+					if lfnNext != 0 {
+						return fmt.Errorf("directory %q has an interrupted long name", path)
+					}
+					lfn = make([]uint16, 13*(ord&^0x40))
+					lfnNext, lfnSum = ord&^0x40, u8(e, 0x0d)
+				} else if ord != lfnNext || u8(e, 0x0d) != lfnSum {
+					return fmt.Errorf("directory %q has a long name entry out of sequence", path)
+				}
+				for i, pos := range []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30} {
+					lfn[13*(lfnNext-1)+i] = uint16(u16(e, pos))
+				}
+				lfnNext--
+				continue
+			}
+
+			var short [11]byte
+			copy(short[:], e[:11])
+			if attrs&0x08 != 0 {
+				if !isRoot || lfn != nil || off != 0 {
+					return fmt.Errorf("directory %q has a misplaced volume label", path)
+				}
+				continue
+			}
+			cluster := u16(e, 0x14)<<16 | u16(e, 0x1a)
+			if !isRoot && off < 64 {
+				want, wantCluster := DotName, self
+				if off == 32 {
+					want, wantCluster = DotDotName, parent
+				}
+				if short != want || cluster != wantCluster || lfn != nil {
+					return fmt.Errorf("directory %q entry %d is %q at %d; want %q at %d", path, off/32, short, cluster, want, wantCluster)
+				}
+				continue
+			}
+
+			var name string
+			if lfn != nil {
+				if lfnNext != 0 {
+					return fmt.Errorf("directory %q has a truncated long name", path)
+				}
+				sum := 0
+				for _, c := range short {
+					sum = ((sum&1)<<7 + sum>>1 + int(c)) & 0xff
+				}
+				if sum != lfnSum {
+					return fmt.Errorf("directory %q has a long name with the wrong checksum", path)
+				}
+				end := len(lfn)
+				for i, c := range lfn {
+					if c == 0 {
+						end = i
+						break
+					}
+				}
+				for i := end + 1; i < len(lfn); i++ {
+					if lfn[i] != 0xffff {
+						return fmt.Errorf("directory %q has a long name with bad padding", path)
+					}
+				}
+				if end == 0 || len(lfn) != 13*((end+12)/13) {
+					return fmt.Errorf("directory %q has a long name with too many entries", path)
+				}
+				name = string(utf16.Decode(lfn[:end]))
+				lfn = nil
+			} else {
+				base := strings.TrimRight(string(short[:8]), " ")
+				ext := strings.TrimRight(string(short[8:]), " ")
+				if e[0x0c]&0x08 != 0 {
+					base = strings.ToLower(base)
+				}
+				if e[0x0c]&0x10 != 0 {
+					ext = strings.ToLower(ext)
+				}
+				name = base
+				if ext != "" {
+					name += "." + ext
+				}
+			}
+			fullName := path + name
+			if _, exists := ret.files[fullName]; exists {
+				return fmt.Errorf("%q appears twice", fullName)
+			}
+
+			size := u32(e, 0x1c)
+			if attrs&0x10 != 0 {
+				ret.files[fullName] = nil
+				if cluster == 0 || size != 0 {
+					return fmt.Errorf("directory %q has cluster %d and size %d", fullName, cluster, size)
+				}
+				table, _, err := chain(cluster, fullName)
+				if err != nil {
+					return err
+				}
+				childParent := self
+				if isRoot {
+					childParent = 0
+				}
+				if err := checkDir(table, fullName+"/", cluster, childParent); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if (cluster == 0) != (size == 0) {
+				return fmt.Errorf("file %q has cluster %d and size %d", fullName, cluster, size)
+			}
+			var body []byte
+			length := 0
+			if cluster != 0 {
+				var err error
+				body, length, err = chain(cluster, fullName)
+				if err != nil {
+					return err
+				}
+			}
+			if want := (size + clusterSize - 1) / clusterSize; length != want {
+				return fmt.Errorf("file %q of %d bytes has %d clusters; want %d", fullName, size, length, want)
+			}
+			ret.files[fullName] = append([]byte{}, body[:size]...)
+		}
+		if lfn != nil {
+			return fmt.Errorf("directory %q ends with an orphaned long name", path)
+		}
+
+		// Subdirectory tables should be no longer than they need to be.
+		if self != 0 || ret.fatType == FAT32 {
+			want := (used*32 + clusterSize - 1) / clusterSize
+			if want == 0 {
+				want = 1
+			}
+			if len(table)/clusterSize != want {
+				return fmt.Errorf("directory %q with %d entries has %d clusters; want %d", path, used, len(table)/clusterSize, want)
+			}
+		}
+		return nil
+	}
+
+	rootCluster := 0
+	var rootTable []byte
+	if ret.fatType == FAT32 {
+		rootCluster = u32(img, 0x2c)
+		var err error
+		rootTable, _, err = chain(rootCluster, "root directory")
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		start := (reserved + fatCount*fatSectors) * bps
+		rootTable = img[start : start+rootSectors*bps]
+	}
+	if err := checkDir(rootTable, "", rootCluster, 0); err != nil {
+		return nil, err
+	}
+
+	// Every allocated cluster must belong to one of the chains we found,
+	// or else it's lost.
+	var lost []int
+	for cluster := 2; cluster < clusterCount+2; cluster++ {
+		if entry(cluster) == 0 {
+			ret.freeClusters++
+		} else if _, ok := owner[cluster]; !ok {
+			lost = append(lost, cluster)
+		}
+	}
+	if len(lost) != 0 {
+		sort.Ints(lost)
+		return nil, fmt.Errorf("%d clusters are allocated but not used, starting with %d", len(lost), lost[0])
+	}
+
+	if ret.fatType == FAT32 {
+		info := img[u16(img, 0x30)*bps:]
+		if free := u32(info, 0x1e8); free != 0xffffffff && free != ret.freeClusters {
+			return nil, fmt.Errorf("FSInfo records %d free clusters; want %d", free, ret.freeClusters)
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,616 @@
+package vfat
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/apparentlymart/go-fsutil/fsutil"
+)
+
+const deletedEntryMarker = 0xe5
+
+// Image is a view of an existing FAT12, FAT16 or FAT32 filesystem, such as
+// one produced by Filesystem.Build.
+//
+// The fields describe the parameters found in the boot record and FSInfo
+// sector. The underlying region is retained and read lazily as directories
+// and files are visited, so the region must not be modified other than
+// through the Image while the Image is in use.
+//
+// The methods that modify the filesystem, such as WriteFile, write directly
+// into the region, which must therefore be writable.
+type Image struct {
+	BytesPerSector    uint32
+	SectorsPerCluster uint32
+	ReservedSectors   uint32
+	FATCount          uint32
+	SectorsPerFAT     uint32
+	TotalSectors      uint32
+	RootCluster       uint32
+	BackupBootSector  uint32
+	VolumeID          uint32
+	Label             [11]byte
+
+	// FATType is the type of the filesystem, which is determined by its
+	// cluster count.
+	FATType FATType
+
+	// RootEntryCount is the number of entries in the fixed root directory
+	// of a FAT12 or FAT16 filesystem. It is zero for FAT32, where the root
+	// directory is a cluster chain starting at RootCluster instead.
+	RootEntryCount uint32
+
+	// FreeClusterCount and NextFreeCluster are the hints from the FSInfo
+	// sector. Either may be 0xffffffff to represent "unknown".
+	FreeClusterCount uint32
+	NextFreeCluster  uint32
+
+	// ClusterCount is the number of clusters in the data area. Valid
+	// cluster numbers are 2 through ClusterCount+1, inclusive.
+	ClusterCount uint32
+
+	// Location is the time zone in which timestamps in directory entries
+	// are interpreted, since FAT does not record one. Open sets it to UTC,
+	// but callers may change it before reading any directories.
+	Location *time.Location
+
+	region     fsutil.Region
+	fat        fsutil.Region
+	fats       []fsutil.Region
+	fsInfo     fsutil.Region
+	root       fsutil.Region
+	data       *fsutil.IndexedRegion
+	clusterLen int
+}
+
+// ImageEntry describes a file or directory found in an Image.
+type ImageEntry struct {
+	DirEntryCommon
+
+	// ShortName is the raw 8.3 name from the directory entry, which
+	// is used as the Name when no valid long filename is present.
+	ShortName [11]byte
+
+	FirstCluster uint32
+	Size         uint32
+}
+
+// IsDir returns true if the entry represents a directory.
+func (e *ImageEntry) IsDir() bool {
+	return e.Attributes&DirectoryAttr != 0
+}
+
+// Open parses the boot record of a FAT filesystem in the given region
+// and returns an Image that can be used to explore its contents.
+func Open(region fsutil.Region) (*Image, error) {
+	if region.Length() < 512 {
+		return nil, fmt.Errorf("region is too short to contain a boot record")
+	}
+
+	br := region.Slice(0, 512)
+	if br.ReadU16LE(0x1fe) != BootableSignature {
+		return nil, fmt.Errorf("boot record signature is missing")
+	}
+
+	var bpb biosParameterBlock
+	if err := br.ReadStruct(0, &bpb); err != nil {
+		return nil, err
+	}
+	img := &Image{
+		BytesPerSector:    uint32(bpb.BytesPerSector),
+		SectorsPerCluster: uint32(bpb.SectorsPerCluster),
+		ReservedSectors:   uint32(bpb.ReservedSectors),
+		FATCount:          uint32(bpb.FATCount),
+		RootEntryCount:    uint32(bpb.RootEntryCount),
+		TotalSectors:      uint32(bpb.TotalSectors16),
+		SectorsPerFAT:     uint32(bpb.SectorsPerFAT16),
+		Location:          time.UTC,
+		region:            region,
+	}
+
+	switch img.BytesPerSector {
+	case 512, 1024, 2048, 4096:
+	default:
+		return nil, fmt.Errorf("unsupported sector size %d", img.BytesPerSector)
+	}
+	spc := img.SectorsPerCluster
+	if spc == 0 || spc&(spc-1) != 0 {
+		return nil, fmt.Errorf("invalid sectors per cluster %d", spc)
+	}
+	if img.ReservedSectors == 0 {
+		return nil, fmt.Errorf("reserved sector count must not be zero")
+	}
+	if img.FATCount == 0 {
+		return nil, fmt.Errorf("FAT count must not be zero")
+	}
+
+	// FAT32 volumes always use the 32-bit fields, leaving the older
+	// 16-bit equivalents set to zero.
+	if img.TotalSectors == 0 {
+		img.TotalSectors = bpb.TotalSectors32
+	}
+	var fat32BPB fat32ParameterBlock
+	if err := br.ReadStruct(0, &fat32BPB); err != nil {
+		return nil, err
+	}
+	fat32Layout := img.SectorsPerFAT == 0
+	if fat32Layout {
+		img.SectorsPerFAT = fat32BPB.SectorsPerFAT
+	}
+
+	sectorSize := int(img.BytesPerSector)
+	rootSectors := divCeil(img.RootEntryCount*DirEntrySize, img.BytesPerSector)
+	rootStart := img.ReservedSectors + img.FATCount*img.SectorsPerFAT
+	dataStart := rootStart + rootSectors
+	if img.SectorsPerFAT == 0 || dataStart >= img.TotalSectors {
+		return nil, fmt.Errorf("FAT layout leaves no room for data")
+	}
+	if region.Length() < int(img.TotalSectors)*sectorSize {
+		return nil, fmt.Errorf(
+			"region is %d bytes, but filesystem needs %d",
+			region.Length(), int(img.TotalSectors)*sectorSize,
+		)
+	}
+
+	img.ClusterCount = (img.TotalSectors - dataStart) / spc
+	img.FATType = fatTypeForClusters(img.ClusterCount)
+	if fat32Layout != (img.FATType == FAT32) || (img.RootEntryCount == 0) != (img.FATType == FAT32) {
+		return nil, fmt.Errorf(
+			"boot record fields are inconsistent with %s, as implied by %d clusters",
+			img.FATType, img.ClusterCount,
+		)
+	}
+
+	img.clusterLen = int(spc) * sectorSize
+	for i := uint32(0); i < img.FATCount; i++ {
+		img.fats = append(img.fats, region.Slice(
+			int(img.ReservedSectors+i*img.SectorsPerFAT)*sectorSize,
+			int(img.SectorsPerFAT)*sectorSize,
+		))
+	}
+	img.fat = img.fats[0]
+	img.root = region.Slice(
+		int(rootStart)*sectorSize,
+		int(img.RootEntryCount)*DirEntrySize,
+	)
+	img.data = region.Slice(
+		int(dataStart)*sectorSize,
+		int(img.ClusterCount)*img.clusterLen,
+	).Indexed()
+	if uint32(img.fat.Length()) < img.FATType.fatBytes(img.ClusterCount+2) {
+		return nil, fmt.Errorf("FAT is too small for %d clusters", img.ClusterCount)
+	}
+
+	img.FreeClusterCount = 0xffffffff
+	img.NextFreeCluster = 0xffffffff
+
+	var ebpb extendedParameterBlock
+	if err := br.ReadStruct(extendedParameterBlockOffset(img.FATType), &ebpb); err != nil {
+		return nil, err
+	}
+	if ebpb.Signature == ExtSignature {
+		img.VolumeID = ebpb.VolumeID
+		img.Label = ebpb.Label
+	}
+
+	if img.FATType != FAT32 {
+		return img, nil
+	}
+
+	img.RootCluster = fat32BPB.RootCluster
+	img.BackupBootSector = uint32(fat32BPB.BackupBootSector)
+	if !img.validCluster(img.RootCluster) {
+		return nil, fmt.Errorf("invalid root directory cluster %d", img.RootCluster)
+	}
+
+	fsInfoSector := uint32(fat32BPB.FSInfoSector)
+	if fsInfoSector != 0 && fsInfoSector != 0xffff {
+		if fsInfoSector >= img.ReservedSectors {
+			return nil, fmt.Errorf("FSInfo sector %d is outside the reserved area", fsInfoSector)
+		}
+		fsInfo := region.Slice(int(fsInfoSector)*sectorSize, sectorSize)
+		var info fsInfoSectorFields
+		if err := fsInfo.ReadStruct(0, &info); err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(info.Signature1[:], FSInfoSignature1) ||
+			!bytes.Equal(info.Signature2[:], FSInfoSignature2) {
+			return nil, fmt.Errorf("FSInfo sector signature is missing")
+		}
+		img.FreeClusterCount = info.FreeClusterCount
+		img.NextFreeCluster = info.NextFreeCluster
+		img.fsInfo = fsInfo
+	}
+
+	return img, nil
+}
+
+func (img *Image) validCluster(cluster uint32) bool {
+	return cluster >= 2 && cluster < img.ClusterCount+2
+}
+
+// FATEntry returns the value of the FAT entry for the given cluster,
+// taken from the first FAT.
+func (img *Image) FATEntry(cluster uint32) uint32 {
+	return img.FATType.readEntry(img.fat, cluster)
+}
+
+// Chain returns the numbers of all of the clusters in the chain that
+// begins with the given cluster, in order.
+func (img *Image) Chain(start uint32) ([]uint32, error) {
+	var chain []uint32
+	cluster := start
+	for {
+		if !img.validCluster(cluster) {
+			return nil, fmt.Errorf("chain from cluster %d refers to invalid cluster %d", start, cluster)
+		}
+		if uint32(len(chain)) >= img.ClusterCount {
+			return nil, fmt.Errorf("chain from cluster %d contains a loop", start)
+		}
+		chain = append(chain, cluster)
+
+		next := img.FATEntry(cluster)
+		switch {
+		case next >= img.FATType.minEndOfChain():
+			return chain, nil
+		case next == img.FATType.badCluster():
+			return nil, fmt.Errorf("chain from cluster %d includes bad cluster %d", start, cluster)
+		case next == 0:
+			return nil, fmt.Errorf("chain from cluster %d includes free cluster %d", start, cluster)
+		}
+		cluster = next
+	}
+}
+
+// chainRegion returns a region covering all of the clusters in the chain
+// that begins with the given cluster.
+func (img *Image) chainRegion(start uint32) (fsutil.Region, error) {
+	chain, err := img.Chain(start)
+	if err != nil {
+		return nil, err
+	}
+
+	mapping := make([]int, len(chain))
+	for i, cluster := range chain {
+		mapping[i] = int(cluster - 2)
+	}
+	return img.data.Blocks(img.clusterLen, mapping), nil
+}
+
+// ReadRootDir returns the entries in the root directory.
+func (img *Image) ReadRootDir() ([]ImageEntry, error) {
+	if img.FATType != FAT32 {
+		return img.readDirTable(img.root)
+	}
+	return img.readDirAt(img.RootCluster)
+}
+
+// ReadDir returns the entries in the given directory entry, which must
+// be a directory.
+func (img *Image) ReadDir(entry *ImageEntry) ([]ImageEntry, error) {
+	if !entry.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", entry.Name)
+	}
+	if entry.FirstCluster == 0 {
+		// Some implementations use cluster zero to refer to the root.
+		return img.ReadRootDir()
+	}
+	return img.readDirAt(entry.FirstCluster)
+}
+
+// FileRegion returns a region covering the contents of the given file entry.
+//
+// The returned region refers to the clusters of the underlying image
+// directly, rather than to a copy.
+func (img *Image) FileRegion(entry *ImageEntry) (fsutil.Region, error) {
+	if entry.IsDir() {
+		return nil, fmt.Errorf("%s is a directory", entry.Name)
+	}
+	if entry.Size == 0 {
+		return fsutil.Region{}, nil
+	}
+
+	body, err := img.chainRegion(entry.FirstCluster)
+	if err != nil {
+		return nil, err
+	}
+	if body.Length() < int(entry.Size) {
+		return nil, fmt.Errorf(
+			"%s is %d bytes, but its chain covers only %d",
+			entry.Name, entry.Size, body.Length(),
+		)
+	}
+	return body.Slice(0, int(entry.Size)), nil
+}
+
+// Lookup finds the entry at the given slash-separated path, relative to
+// the root directory. Names are compared case-insensitively, as they are
+// by FAT implementations.
+//
+// If the path does not exist, the returned error wraps fs.ErrNotExist.
+func (img *Image) Lookup(name string) (*ImageEntry, error) {
+	name = strings.Trim(path.Clean("/"+name), "/")
+	if name == "" {
+		return nil, fmt.Errorf("the root directory has no entry")
+	}
+
+	entries, err := img.ReadRootDir()
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.Split(name, "/")
+	for i, part := range parts {
+		var found *ImageEntry
+		for j := range entries {
+			if strings.EqualFold(entries[j].Name, part) {
+				found = &entries[j]
+				break
+			}
+		}
+		if found == nil {
+			return nil, &fs.PathError{
+				Op:   "lookup",
+				Path: path.Join(parts[:i+1]...),
+				Err:  fs.ErrNotExist,
+			}
+		}
+		if i == len(parts)-1 {
+			return found, nil
+		}
+		if !found.IsDir() {
+			return nil, &fs.PathError{
+				Op:   "lookup",
+				Path: path.Join(parts[:i+2]...),
+				Err:  fs.ErrNotExist,
+			}
+		}
+
+		entries, err = img.ReadDir(found)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Unreachable, since parts always has at least one element.
+	return nil, nil
+}
+
+func (img *Image) readDirAt(cluster uint32) ([]ImageEntry, error) {
+	table, err := img.chainRegion(cluster)
+	if err != nil {
+		return nil, err
+	}
+	return img.readDirTable(table)
+}
+
+// readDirTable decodes the entries in the given directory table.
+func (img *Image) readDirTable(table fsutil.Region) ([]ImageEntry, error) {
+	slots, err := img.scanDirTable(table)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]ImageEntry, len(slots))
+	for i, slot := range slots {
+		ret[i] = slot.ImageEntry
+	}
+	return ret, nil
+}
+
+// dirSlot is an entry found in a directory table, along with the range of
+// table offsets it occupies, including any long filename entries.
+type dirSlot struct {
+	ImageEntry
+	start, end int
+}
+
+// scanDirTable decodes the entries in the given directory table, recording
+// where each one was found.
+func (img *Image) scanDirTable(table fsutil.Region) ([]dirSlot, error) {
+	var ret []dirSlot
+
+	// Long filename entries preceding a short entry are accumulated
+	// here until we find the short entry they belong to.
+	var lfnParts [][]uint16
+	var lfnChecksum byte
+	lfnNext := 0
+	lfnStart := 0
+
+	index := table.Indexed()
+	tableLen := index.Length()
+	for ofs := 0; ofs+DirEntrySize <= tableLen; ofs += DirEntrySize {
+		entry := index.Slice(ofs, DirEntrySize)
+		var short shortDirEntry
+		if err := entry.ReadStruct(0, &short); err != nil {
+			return nil, err
+		}
+		first := short.Name[0]
+		attrs := Attributes(short.Attributes)
+
+		if first == 0x00 {
+			// End of directory
+			break
+		}
+		if first == deletedEntryMarker {
+			lfnParts = nil
+			continue
+		}
+
+		if attrs&0x3f == LFNAttrs {
+			var lfn lfnDirEntry
+			if err := entry.ReadStruct(0, &lfn); err != nil {
+				return nil, err
+			}
+			seq := int(lfn.Sequence &^ lfnLastEntryFlag)
+			switch {
+			case lfn.Sequence&lfnLastEntryFlag != 0 && seq > 0:
+				lfnParts = make([][]uint16, seq)
+				lfnChecksum = lfn.Checksum
+				lfnStart = ofs
+			case lfnParts != nil && seq > 0 && seq == lfnNext && lfn.Checksum == lfnChecksum:
+				// Continuing the current sequence
+			default:
+				// Orphaned entry, so we'll discard anything we've found
+				// so far and ignore this one.
+				lfnParts = nil
+				continue
+			}
+			lfnParts[seq-1] = lfn.chars()
+			lfnNext = seq - 1
+			continue
+		}
+
+		shortName := short.Name
+		if attrs&VolumeIDAttr != 0 || shortName[0] == '.' {
+			// Volume labels and the "." and ".." entries don't
+			// represent real files or directories.
+			lfnParts = nil
+			continue
+		}
+
+		var name string
+		start := ofs
+		if lfnParts != nil && lfnNext == 0 && shortNameChecksum(shortName[:]) == lfnChecksum {
+			start = lfnStart
+			var chars []uint16
+			for _, part := range lfnParts {
+				chars = append(chars, part...)
+			}
+			for i, c := range chars {
+				if c == 0 {
+					chars = chars[:i]
+					break
+				}
+			}
+			name = string(utf16.Decode(chars))
+		} else {
+			name = formatShortName(shortName, short.CaseFlags)
+		}
+		lfnParts = nil
+
+		ret = append(ret, dirSlot{ImageEntry: ImageEntry{
+			DirEntryCommon: DirEntryCommon{
+				Name:       name,
+				Attributes: attrs,
+				CreationTime: decodeDOSTime(
+					short.CreationDate, short.CreationTime, short.CreationTenMs,
+					img.Location,
+				),
+				LastAccessedTime: decodeDOSTime(
+					short.AccessDate, 0, 0, img.Location,
+				),
+				LastModifiedTime: decodeDOSTime(
+					short.ModifiedDate, short.ModifiedTime, 0, img.Location,
+				),
+			},
+			ShortName:    shortName,
+			FirstCluster: short.cluster(),
+			Size:         short.Size,
+		}, start: start, end: ofs + DirEntrySize})
+	}
+
+	return ret, nil
+}
+
+// shortNameChecksum computes the checksum of an 8.3 filename that is
+// recorded in each of its associated long filename entries.
+func shortNameChecksum(dosFN []byte) byte {
+	checksum := byte(0)
+	for _, b := range dosFN {
+		checksum = ((checksum & 1) << 7) + (checksum >> 1) + b
+	}
+	return checksum
+}
+
+// formatShortName turns a raw 8.3 filename into the conventional
+// "NAME.EXT" form, honouring the lowercase flags some implementations
+// record in the reserved byte at offset 0x0c.
+func formatShortName(raw [11]byte, caseFlags byte) string {
+	if raw[0] == 0x05 {
+		// 0xe5 is used to mark deleted entries, so a name really starting
+		// with that byte has it replaced.
+		raw[0] = 0xe5
+	}
+
+	base := strings.TrimRight(string(raw[0:8]), " ")
+	ext := strings.TrimRight(string(raw[8:11]), " ")
+	if caseFlags&0x08 != 0 {
+		base = strings.ToLower(base)
+	}
+	if caseFlags&0x10 != 0 {
+		ext = strings.ToLower(ext)
+	}
+
+	if ext == "" {
+		return base
+	}
+	return base + "." + ext
+}
+
+// FreeSpace counts the free clusters recorded in the first FAT, returning
+// the count and the number of the first free cluster, or 0xffffffff if
+// there are none. These are the values that the FSInfo sector of a FAT32
+// filesystem records as hints.
+func (img *Image) FreeSpace() (freeCount, firstFree uint32) {
+	firstFree = 0xffffffff
+	for cluster := uint32(2); cluster < img.ClusterCount+2; cluster++ {
+		if img.FATEntry(cluster) != 0 {
+			continue
+		}
+		if freeCount == 0 {
+			firstFree = cluster
+		}
+		freeCount++
+	}
+	return freeCount, firstFree
+}
+
+// FSInfoDiscrepancy describes a hint in the FSInfo sector whose value
+// differs from the one computed from the FAT.
+type FSInfoDiscrepancy struct {
+	Field    string
+	Recorded uint32
+	Actual   uint32
+}
+
+func (d FSInfoDiscrepancy) String() string {
+	return fmt.Sprintf("%s is %d, but should be %d", d.Field, d.Recorded, d.Actual)
+}
+
+// VerifyFSInfo recomputes the free space hints from the FAT, as FreeSpace
+// does, and compares them to those recorded in the FSInfo sector. It
+// returns a discrepancy for each hint that differs, or nil if they are
+// consistent or the filesystem has no FSInfo sector.
+//
+// Hints recorded as 0xffffffff, meaning "unknown", are not reported.
+// Implementations differ in how they use NextFreeCluster, so a discrepancy
+// in it is less serious than one in FreeClusterCount.
+func (img *Image) VerifyFSInfo() []FSInfoDiscrepancy {
+	if img.fsInfo == nil {
+		return nil
+	}
+
+	var ret []FSInfoDiscrepancy
+	freeCount, firstFree := img.FreeSpace()
+	if img.FreeClusterCount != 0xffffffff && img.FreeClusterCount != freeCount {
+		ret = append(ret, FSInfoDiscrepancy{
+			Field:    "FreeClusterCount",
+			Recorded: img.FreeClusterCount,
+			Actual:   freeCount,
+		})
+	}
+	if img.NextFreeCluster != 0xffffffff && img.NextFreeCluster != firstFree {
+		ret = append(ret, FSInfoDiscrepancy{
+			Field:    "NextFreeCluster",
+			Recorded: img.NextFreeCluster,
+			Actual:   firstFree,
+		})
+	}
+	return ret
+}
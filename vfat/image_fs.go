@@ -0,0 +1,316 @@
+package vfat
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"sort"
+	"time"
+
+	"github.com/apparentlymart/go-fsutil/fsutil"
+)
+
+// ImageFS presents an Image as an io/fs filesystem, so that it can be used
+// with the standard library functions that accept one.
+//
+// The Sys method of each fs.FileInfo it returns gives the *ImageEntry the
+// information was derived from, or nil for the root directory.
+type ImageFS struct {
+	img *Image
+}
+
+var _ fs.FS = (*ImageFS)(nil)
+var _ fs.ReadDirFS = (*ImageFS)(nil)
+var _ fs.StatFS = (*ImageFS)(nil)
+var _ fs.ReadFileFS = (*ImageFS)(nil)
+
+// FS returns an io/fs view of the image.
+func (img *Image) FS() *ImageFS {
+	return &ImageFS{img}
+}
+
+// OpenFS is a convenience wrapper around Open that returns an io/fs view
+// of the image in the given region.
+func OpenFS(region fsutil.Region) (*ImageFS, error) {
+	img, err := Open(region)
+	if err != nil {
+		return nil, err
+	}
+	return img.FS(), nil
+}
+
+// lookup finds the entry for a valid io/fs path, returning a nil entry
+// for the root directory.
+func (ifs *ImageFS) lookup(op, name string) (*ImageEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return nil, nil
+	}
+
+	entry, err := ifs.img.Lookup(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	} else if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return entry, nil
+}
+
+func (ifs *ImageFS) readDir(entry *ImageEntry) ([]ImageEntry, error) {
+	if entry == nil {
+		return ifs.img.ReadRootDir()
+	}
+	return ifs.img.ReadDir(entry)
+}
+
+// readDirEntries returns the contents of a directory sorted by name, as
+// required by fs.ReadDirFS.
+func (ifs *ImageFS) readDirEntries(entry *ImageEntry) ([]fs.DirEntry, error) {
+	entries, err := ifs.readDir(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]fs.DirEntry, len(entries))
+	for i := range entries {
+		ret[i] = fs.FileInfoToDirEntry(&imageFileInfo{&entries[i]})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name() < ret[j].Name()
+	})
+	return ret, nil
+}
+
+// Open implements fs.FS.
+func (ifs *ImageFS) Open(name string) (fs.File, error) {
+	entry, err := ifs.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &imageFileInfo{entry}
+	if info.IsDir() {
+		entries, err := ifs.readDirEntries(entry)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		return &imageDir{info: info, entries: entries}, nil
+	}
+
+	body, err := ifs.img.FileRegion(entry)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &imageFile{info: info, body: body.Indexed()}, nil
+}
+
+// ReadDir implements fs.ReadDirFS.
+func (ifs *ImageFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entry, err := ifs.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if entry != nil && !entry.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+
+	entries, err := ifs.readDirEntries(entry)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	return entries, nil
+}
+
+// Stat implements fs.StatFS.
+func (ifs *ImageFS) Stat(name string) (fs.FileInfo, error) {
+	entry, err := ifs.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return &imageFileInfo{entry}, nil
+}
+
+// ReadFile implements fs.ReadFileFS.
+func (ifs *ImageFS) ReadFile(name string) ([]byte, error) {
+	entry, err := ifs.lookup("readfile", name)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil || entry.IsDir() {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: fs.ErrInvalid}
+	}
+
+	body, err := ifs.img.FileRegion(entry)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: err}
+	}
+	return body.Bytes(), nil
+}
+
+// imageFileInfo implements fs.FileInfo for an ImageEntry. A nil entry
+// represents the root directory.
+type imageFileInfo struct {
+	entry *ImageEntry
+}
+
+func (fi *imageFileInfo) Name() string {
+	if fi.entry == nil {
+		return "."
+	}
+	return fi.entry.Name
+}
+
+func (fi *imageFileInfo) Size() int64 {
+	if fi.entry == nil {
+		return 0
+	}
+	return int64(fi.entry.Size)
+}
+
+// Mode maps the FAT attributes onto the closest equivalent file mode.
+// Read-only entries have no write permission, and since there is no mode
+// bit for hidden entries they instead have permissions only for the owner.
+func (fi *imageFileInfo) Mode() fs.FileMode {
+	if fi.entry == nil {
+		return fs.ModeDir | 0755
+	}
+
+	mode := fs.FileMode(0644)
+	if fi.entry.IsDir() {
+		mode = fs.ModeDir | 0755
+	}
+	if fi.entry.Attributes&ReadOnlyAttr != 0 {
+		mode &^= 0222
+	}
+	if fi.entry.Attributes&HiddenAttr != 0 {
+		mode &^= 0077
+	}
+	return mode
+}
+
+func (fi *imageFileInfo) ModTime() time.Time {
+	if fi.entry == nil {
+		return time.Time{}
+	}
+	return fi.entry.LastModifiedTime
+}
+
+func (fi *imageFileInfo) IsDir() bool {
+	return fi.entry == nil || fi.entry.IsDir()
+}
+
+// Sys returns the *ImageEntry for the file, or nil for the root directory,
+// which has no entry.
+func (fi *imageFileInfo) Sys() interface{} {
+	if fi.entry == nil {
+		return nil
+	}
+	return fi.entry
+}
+
+// imageFile implements fs.File for a regular file in an image.
+type imageFile struct {
+	info   *imageFileInfo
+	body   *fsutil.IndexedRegion
+	offset int64
+	closed bool
+}
+
+func (f *imageFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *imageFile) Read(buf []byte) (int, error) {
+	n, err := f.ReadAt(buf, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *imageFile) ReadAt(buf []byte, offset int64) (int, error) {
+	if f.closed {
+		return 0, &fs.PathError{Op: "read", Path: f.info.Name(), Err: fs.ErrClosed}
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "read", Path: f.info.Name(), Err: fs.ErrInvalid}
+	}
+	return f.body.ReadAt(buf, offset)
+}
+
+func (f *imageFile) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, &fs.PathError{Op: "seek", Path: f.info.Name(), Err: fs.ErrClosed}
+	}
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(f.body.Length())
+	default:
+		offset = -1
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.info.Name(), Err: fs.ErrInvalid}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *imageFile) Close() error {
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.info.Name(), Err: fs.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
+
+// imageDir implements fs.ReadDirFile for a directory in an image.
+type imageDir struct {
+	info    *imageFileInfo
+	entries []fs.DirEntry
+	closed  bool
+}
+
+func (d *imageDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *imageDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.Name(), Err: fs.ErrInvalid}
+}
+
+func (d *imageDir) ReadDir(count int) ([]fs.DirEntry, error) {
+	if d.closed {
+		return nil, &fs.PathError{Op: "readdir", Path: d.info.Name(), Err: fs.ErrClosed}
+	}
+
+	if count <= 0 {
+		ret := d.entries
+		d.entries = nil
+		return ret, nil
+	}
+
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(d.entries) {
+		count = len(d.entries)
+	}
+	ret := d.entries[:count]
+	d.entries = d.entries[count:]
+	return ret, nil
+}
+
+func (d *imageDir) Close() error {
+	if d.closed {
+		return &fs.PathError{Op: "close", Path: d.info.Name(), Err: fs.ErrClosed}
+	}
+	d.closed = true
+	return nil
+}
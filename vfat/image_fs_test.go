@@ -0,0 +1,90 @@
+package vfat
+
+import (
+	"io/fs"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/apparentlymart/go-fsutil/fsutil"
+)
+
+func TestImageFS(t *testing.T) {
+	modTime := time.Date(2016, 7, 4, 13, 45, 30, 0, time.UTC)
+
+	vfs := &Filesystem{
+		RootDir: &Directory{
+			Dirs: []DirEntryDir{
+				{
+					DirEntryCommon: DirEntryCommon{Name: "docs"},
+					Directory: &Directory{
+						Files: []DirEntryFile{
+							{
+								DirEntryCommon: DirEntryCommon{
+									Name:             "readme.txt",
+									LastModifiedTime: modTime,
+								},
+								BodyBuilder: &fsutil.BufferRegionBuilder{
+									Buffer: []byte("Read me!"),
+								},
+							},
+						},
+					},
+				},
+			},
+			Files: []DirEntryFile{
+				{
+					DirEntryCommon: DirEntryCommon{
+						Name:       "secret",
+						Attributes: ReadOnlyAttr | HiddenAttr,
+					},
+					BodyBuilder: &fsutil.BufferRegionBuilder{
+						Buffer: []byte("shh"),
+					},
+				},
+			},
+		},
+	}
+
+	ifs := buildTestImage(t, vfs).FS()
+
+	err := fstest.TestFS(ifs, "docs", "docs/readme.txt", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := ifs.Stat("secret")
+	if err != nil {
+		t.Fatalf("failed to stat secret: %s", err)
+	}
+	if got, want := info.Mode(), fs.FileMode(0400); got != want {
+		t.Errorf("secret has mode %s; want %s", got, want)
+	}
+
+	info, err = ifs.Stat("docs/readme.txt")
+	if err != nil {
+		t.Fatalf("failed to stat docs/readme.txt: %s", err)
+	}
+	if got := info.ModTime(); !got.Equal(modTime) {
+		t.Errorf("docs/readme.txt modified at %s; want %s", got, modTime)
+	}
+
+	info, err = ifs.Stat("docs")
+	if err != nil {
+		t.Fatalf("failed to stat docs: %s", err)
+	}
+	if got, want := info.Mode(), fs.ModeDir|0755; got != want {
+		t.Errorf("docs has mode %s; want %s", got, want)
+	}
+	if entry, ok := info.Sys().(*ImageEntry); !ok || entry.Name != "docs" {
+		t.Errorf("docs has Sys %#v; want its *ImageEntry", info.Sys())
+	}
+
+	info, err = ifs.Stat(".")
+	if err != nil {
+		t.Fatalf("failed to stat root directory: %s", err)
+	}
+	if sys := info.Sys(); sys != nil {
+		t.Errorf("root directory has Sys %#v; want nil", sys)
+	}
+}
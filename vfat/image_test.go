@@ -0,0 +1,247 @@
+package vfat
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/apparentlymart/go-fsutil/fsutil"
+)
+
+func buildTestImage(t *testing.T, fs *Filesystem) *Image {
+	region := fsutil.RegionForBytes(make([]byte, fs.Length()))
+	if err := fs.Build(region); err != nil {
+		t.Fatalf("failed to build image: %s", err)
+	}
+
+	img, err := Open(region)
+	if err != nil {
+		t.Fatalf("failed to open image: %s", err)
+	}
+	return img
+}
+
+func TestOpenRoundTrip(t *testing.T) {
+	longName := strings.Repeat("long file name ", 4) + ".txt"
+	bigBody := bytes.Repeat([]byte("0123456789abcdef"), 1000)
+
+	fs := &Filesystem{
+		VolumeID:          0xdeadbeef,
+		Label:             [11]byte{'T', 'E', 'S', 'T', ' ', ' ', ' ', ' ', ' ', ' ', ' '},
+		ExtraClusterCount: 4,
+		RootDir: &Directory{
+			Dirs: []DirEntryDir{
+				{
+					DirEntryCommon: DirEntryCommon{Name: "subdir"},
+					Directory: &Directory{
+						Files: []DirEntryFile{
+							{
+								DirEntryCommon: DirEntryCommon{Name: longName},
+								BodyBuilder:    &fsutil.BufferRegionBuilder{Buffer: bigBody},
+							},
+						},
+					},
+				},
+			},
+			Files: []DirEntryFile{
+				{
+					DirEntryCommon: DirEntryCommon{Name: "hello.txt"},
+					BodyBuilder: &fsutil.BufferRegionBuilder{
+						Buffer: []byte("Hello, world!"),
+					},
+				},
+				{
+					DirEntryCommon: DirEntryCommon{Name: "empty"},
+					BodyBuilder:    &fsutil.BufferRegionBuilder{},
+				},
+			},
+		},
+	}
+
+	img := buildTestImage(t, fs)
+
+	if img.VolumeID != fs.VolumeID {
+		t.Errorf("VolumeID is 0x%08x; want 0x%08x", img.VolumeID, fs.VolumeID)
+	}
+	if img.Label != fs.Label {
+		t.Errorf("Label is %q; want %q", img.Label, fs.Label)
+	}
+
+	entries, err := img.ReadRootDir()
+	if err != nil {
+		t.Fatalf("failed to read root directory: %s", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name)
+	}
+	if got, want := strings.Join(names, ","), "subdir,hello.txt,empty"; got != want {
+		t.Errorf("root directory contains %s; want %s", got, want)
+	}
+
+	tests := map[string][]byte{
+		"hello.txt":          []byte("Hello, world!"),
+		"empty":              []byte{},
+		"SUBDIR/" + longName: bigBody,
+	}
+	for name, want := range tests {
+		entry, err := img.Lookup(name)
+		if err != nil {
+			t.Errorf("failed to find %s: %s", name, err)
+			continue
+		}
+		body, err := img.FileRegion(entry)
+		if err != nil {
+			t.Errorf("failed to read %s: %s", name, err)
+			continue
+		}
+		if got := body.Bytes(); !bytes.Equal(got, want) {
+			t.Errorf("%s contains %q; want %q", name, got, want)
+		}
+	}
+}
+
+func TestOpenInvalid(t *testing.T) {
+	_, err := Open(fsutil.RegionForBytes(make([]byte, 4096)))
+	if err == nil {
+		t.Errorf("succeeded in opening an empty region; want error")
+	}
+}
+
+func TestDotEntries(t *testing.T) {
+	img := buildTestImage(t, &Filesystem{
+		RootDir: &Directory{
+			Dirs: []DirEntryDir{
+				{
+					DirEntryCommon: DirEntryCommon{Name: "a"},
+					Directory: &Directory{
+						Dirs: []DirEntryDir{
+							{
+								DirEntryCommon: DirEntryCommon{Name: "b"},
+								Directory:      &Directory{},
+							},
+						},
+					},
+				},
+			},
+		},
+	})
+
+	a, err := img.Lookup("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := img.Lookup("a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		dir    *ImageEntry
+		dot    uint32
+		dotDot uint32
+	}{
+		{a, a.FirstCluster, 0},
+		{b, b.FirstCluster, a.FirstCluster},
+	}
+	for _, test := range tests {
+		table, err := img.chainRegion(test.dir.FirstCluster)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, want := range []struct {
+			name    [11]byte
+			cluster uint32
+		}{{DotName, test.dot}, {DotDotName, test.dotDot}} {
+			entry := table.Slice(i*DirEntrySize, DirEntrySize)
+			var name [11]byte
+			copy(name[:], entry.Slice(0, 11).Bytes())
+			cluster := uint32(entry.ReadU16LE(0x14))<<16 | uint32(entry.ReadU16LE(0x1a))
+			attrs := Attributes(entry.ReadU8(0x0b))
+			if name != want.name || cluster != want.cluster || attrs != DirectoryAttr {
+				t.Errorf(
+					"%s entry %d is %q at cluster %d with attributes 0x%02x; want %q at cluster %d",
+					test.dir.Name, i, name, cluster, attrs, want.name, want.cluster,
+				)
+			}
+		}
+	}
+}
+
+func TestVerifyFSInfo(t *testing.T) {
+	img := buildTestImage(t, &Filesystem{
+		FATType:           FAT32,
+		ClusterSize:       512,
+		ExtraClusterCount: 100,
+		RootDir: &Directory{
+			Files: []DirEntryFile{
+				{
+					DirEntryCommon: DirEntryCommon{Name: "a.txt"},
+					BodyBuilder:    &fsutil.BufferRegionBuilder{Buffer: []byte("a")},
+				},
+			},
+		},
+	})
+
+	freeCount, firstFree := img.FreeSpace()
+	if img.FreeClusterCount != freeCount || img.NextFreeCluster != firstFree {
+		t.Errorf(
+			"FSInfo records %d free clusters from %d; want %d from %d",
+			img.FreeClusterCount, img.NextFreeCluster, freeCount, firstFree,
+		)
+	}
+	if got := img.VerifyFSInfo(); got != nil {
+		t.Errorf("built image has discrepancies %v", got)
+	}
+
+	img.fsInfo.WriteU32LE(0x1e8, freeCount+5)
+	img, err := Open(img.region)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []FSInfoDiscrepancy{
+		{Field: "FreeClusterCount", Recorded: freeCount + 5, Actual: freeCount},
+	}
+	if got := img.VerifyFSInfo(); !reflect.DeepEqual(got, want) {
+		t.Errorf("discrepancies are %v; want %v", got, want)
+	}
+}
+
+func TestReadMalformedLFN(t *testing.T) {
+	img := buildTestImage(t, &Filesystem{
+		FATType: FAT16,
+		RootDir: &Directory{
+			Files: []DirEntryFile{
+				{
+					DirEntryCommon: DirEntryCommon{Name: "A.TXT"},
+					BodyBuilder:    &fsutil.BufferRegionBuilder{Buffer: []byte("a")},
+				},
+			},
+		},
+	})
+
+	// We move the file's entry along by two and put a long name sequence
+	// in front of it whose second entry has a sequence number of zero,
+	// which is not a valid continuation of the first.
+	rootStart := (img.ReservedSectors + img.FATCount*img.SectorsPerFAT) * img.BytesPerSector
+	root := img.region.Slice(int(rootStart), 3*DirEntrySize)
+	short := root.Slice(0, DirEntrySize).Bytes()
+	root.WriteBytes(2*DirEntrySize, short)
+	checksum := shortNameChecksum(short[:11])
+	for i, seq := range []byte{0x41, 0x40} {
+		entry := make([]byte, DirEntrySize)
+		entry[0x00] = seq
+		entry[0x0b] = byte(LFNAttrs)
+		entry[0x0d] = checksum
+		root.WriteBytes(i*DirEntrySize, entry)
+	}
+
+	entries, err := img.ReadRootDir()
+	if err != nil {
+		t.Fatalf("failed to read root directory: %s", err)
+	}
+	if len(entries) != 1 || entries[0].Name != "A.TXT" {
+		t.Errorf("root directory contains %#v; want only A.TXT", entries)
+	}
+}
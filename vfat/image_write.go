@@ -0,0 +1,667 @@
+package vfat
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/apparentlymart/go-fsutil/fsutil"
+)
+
+// The methods in this file modify an existing filesystem in place. They
+// allocate clusters from those that are free, keep every copy of the FAT
+// in step, and update the FSInfo hints on FAT32.
+//
+// Each operation either succeeds or returns an error before modifying the
+// filesystem, except where noted. They are not safe for concurrent use,
+// and any ImageEntry values or regions obtained before a modification may
+// no longer describe the filesystem afterwards.
+
+var (
+	errIsDir    = errors.New("is a directory")
+	errNotDir   = errors.New("not a directory")
+	errNotEmpty = errors.New("directory not empty")
+	errNoSpace  = errors.New("no space left in filesystem")
+	errRootFull = errors.New("root directory is full")
+)
+
+// WriteFile creates the named file with the content produced by the given
+// builder, or replaces the content of the file if it already exists. The
+// file's modification time is set to modTime, as is its creation time if it
+// is new. New files are given the archive attribute, while existing files
+// keep their attributes.
+//
+// The directory containing the file must already exist. If the builder
+// fails, an existing file is left empty and a new file is not created.
+func (img *Image) WriteFile(name string, body fsutil.RegionBuilder, modTime time.Time) error {
+	const op = "writefile"
+	parent, base, err := img.parentTable(op, name)
+	if err != nil {
+		return err
+	}
+	slots, err := img.scanDirTable(parent.region)
+	if err != nil {
+		return &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	existing := findSlot(slots, base)
+	if existing != nil && existing.IsDir() {
+		return &fs.PathError{Op: op, Path: name, Err: errIsDir}
+	}
+
+	size := body.Length()
+	if uint64(size) > 0xffffffff {
+		return &fs.PathError{Op: op, Path: name, Err: fmt.Errorf("file is %d bytes, but FAT allows at most 4GiB-1", size)}
+	}
+
+	start := uint32(0)
+	if existing != nil {
+		start = existing.FirstCluster
+	}
+	start, err = img.resizeChain(start, divCeil(uint32(size), uint32(img.clusterLen)))
+	if err != nil {
+		return &fs.PathError{Op: op, Path: name, Err: err}
+	}
+
+	var buildErr error
+	if size > 0 {
+		region, err := img.chainRegion(start)
+		if err == nil {
+			err = body.Build(region.Slice(0, size))
+		}
+		if err != nil {
+			// Freeing clusters can't fail, so this leaves the file empty.
+			start, _ = img.resizeChain(start, 0)
+			size = 0
+			buildErr = fmt.Errorf("failed to build %s: %w", name, err)
+			if existing == nil {
+				return buildErr
+			}
+		}
+	}
+
+	date, tod, tenMillis, _ := encodeDOSTime(modTime, img.Location)
+	if existing != nil {
+		ofs := existing.end - DirEntrySize
+		var short shortDirEntry
+		if err := parent.region.ReadStruct(ofs, &short); err != nil {
+			return err
+		}
+		short.setCluster(start)
+		short.Size = uint32(size)
+		short.ModifiedDate, short.ModifiedTime = date, tod
+		short.AccessDate = date
+		if err := parent.region.WriteStruct(ofs, &short); err != nil {
+			return err
+		}
+		return buildErr
+	}
+
+	short := shortDirEntry{
+		Attributes:    uint8(ArchiveAttr),
+		CreationTenMs: tenMillis,
+		CreationTime:  tod,
+		CreationDate:  date,
+		AccessDate:    date,
+		ModifiedTime:  tod,
+		ModifiedDate:  date,
+		Size:          uint32(size),
+	}
+	short.setCluster(start)
+	if err := img.addEntry(parent, slots, base, short); err != nil {
+		img.resizeChain(start, 0)
+		return &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return nil
+}
+
+// Mkdir creates a new, empty directory with the given name. Its creation
+// and modification times are set to modTime.
+//
+// The directory containing the new directory must already exist.
+func (img *Image) Mkdir(name string, modTime time.Time) error {
+	const op = "mkdir"
+	parent, base, err := img.parentTable(op, name)
+	if err != nil {
+		return err
+	}
+	slots, err := img.scanDirTable(parent.region)
+	if err != nil {
+		return &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	if findSlot(slots, base) != nil {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrExist}
+	}
+
+	clusters, err := img.allocClusters(1, 0)
+	if err != nil {
+		return &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	cluster := clusters[0]
+	img.clearCluster(cluster)
+	table := img.clusterRegion(cluster)
+
+	date, tod, tenMillis, _ := encodeDOSTime(modTime, img.Location)
+	short := shortDirEntry{
+		Attributes:    uint8(DirectoryAttr),
+		CreationTenMs: tenMillis,
+		CreationTime:  tod,
+		CreationDate:  date,
+		AccessDate:    date,
+		ModifiedTime:  tod,
+		ModifiedDate:  date,
+	}
+
+	// Every directory other than the root begins with the "." and ".."
+	// entries, referring to itself and its parent, respectively.
+	dot := short
+	dot.Name = DotName
+	dot.setCluster(cluster)
+	dotDot := short
+	dotDot.Name = DotDotName
+	dotDot.setCluster(parent.parentRef())
+	if err := table.WriteStruct(0, &dot); err != nil {
+		return err
+	}
+	if err := table.WriteStruct(DirEntrySize, &dotDot); err != nil {
+		return err
+	}
+
+	short.setCluster(cluster)
+	if err := img.addEntry(parent, slots, base, short); err != nil {
+		img.freeClusters(clusters)
+		return &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return nil
+}
+
+// Remove removes the named file or empty directory, freeing its clusters.
+func (img *Image) Remove(name string) error {
+	const op = "remove"
+	parent, base, err := img.parentTable(op, name)
+	if err != nil {
+		return err
+	}
+	slots, err := img.scanDirTable(parent.region)
+	if err != nil {
+		return &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	slot := findSlot(slots, base)
+	if slot == nil {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+
+	var chain []uint32
+	if slot.FirstCluster != 0 {
+		chain, err = img.Chain(slot.FirstCluster)
+		if err != nil {
+			return &fs.PathError{Op: op, Path: name, Err: err}
+		}
+	}
+	if slot.IsDir() {
+		entries, err := img.ReadDir(&slot.ImageEntry)
+		if err != nil {
+			return &fs.PathError{Op: op, Path: name, Err: err}
+		}
+		if len(entries) != 0 {
+			return &fs.PathError{Op: op, Path: name, Err: errNotEmpty}
+		}
+	}
+
+	markDeleted(parent.region, slot)
+	img.freeClusters(chain)
+	return nil
+}
+
+// Rename renames the file or directory oldName to newName, which may be in
+// a different directory. The entry keeps its content, attributes and
+// timestamps, but is given a new short name if necessary.
+//
+// The directory that will contain newName must already exist, and newName
+// itself must not exist unless it differs from oldName only by case.
+func (img *Image) Rename(oldName, newName string) error {
+	const op = "rename"
+	oldParent, oldBase, err := img.parentTable(op, oldName)
+	if err != nil {
+		return err
+	}
+	oldSlots, err := img.scanDirTable(oldParent.region)
+	if err != nil {
+		return &fs.PathError{Op: op, Path: oldName, Err: err}
+	}
+	slot := findSlot(oldSlots, oldBase)
+	if slot == nil {
+		return &fs.PathError{Op: op, Path: oldName, Err: fs.ErrNotExist}
+	}
+
+	newParent, newBase, err := img.parentTable(op, newName)
+	if err != nil {
+		return err
+	}
+	sameDir := newParent.cluster == oldParent.cluster
+	newSlots := oldSlots
+	if !sameDir {
+		newSlots, err = img.scanDirTable(newParent.region)
+		if err != nil {
+			return &fs.PathError{Op: op, Path: newName, Err: err}
+		}
+	}
+	if existing := findSlot(newSlots, newBase); existing != nil {
+		if !sameDir || existing.start != slot.start {
+			return &fs.PathError{Op: op, Path: newName, Err: fs.ErrExist}
+		}
+	}
+
+	if slot.IsDir() && !sameDir {
+		// A directory can't be moved into itself or its own descendents.
+		oldPath := cleanImagePath(oldName)
+		newPath := cleanImagePath(newName)
+		if len(newPath) > len(oldPath) && strings.EqualFold(newPath[:len(oldPath)+1], oldPath+"/") {
+			return &fs.PathError{Op: op, Path: newName, Err: fs.ErrInvalid}
+		}
+	}
+
+	var short shortDirEntry
+	if err := oldParent.region.ReadStruct(slot.end-DirEntrySize, &short); err != nil {
+		return err
+	}
+
+	// The entry's current short name shouldn't prevent it from keeping
+	// that name, so we leave it out when choosing a new one.
+	others := make([]dirSlot, 0, len(newSlots))
+	for _, s := range newSlots {
+		if !sameDir || s.start != slot.start {
+			others = append(others, s)
+		}
+	}
+	if err := img.addEntry(newParent, others, newBase, short); err != nil {
+		return &fs.PathError{Op: op, Path: newName, Err: err}
+	}
+	markDeleted(oldParent.region, slot)
+
+	if slot.IsDir() && !sameDir && slot.FirstCluster != 0 {
+		// The directory's ".." entry must now refer to its new parent.
+		table, err := img.chainRegion(slot.FirstCluster)
+		if err != nil {
+			return &fs.PathError{Op: op, Path: newName, Err: err}
+		}
+		var dotDot shortDirEntry
+		if err := table.ReadStruct(DirEntrySize, &dotDot); err != nil {
+			return err
+		}
+		if dotDot.Name == DotDotName {
+			dotDot.setCluster(newParent.parentRef())
+			if err := table.WriteStruct(DirEntrySize, &dotDot); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// dirTable is a directory table that is being modified.
+type dirTable struct {
+	// cluster is the first cluster of the table, which is zero for the
+	// fixed root directory of FAT12 and FAT16.
+	cluster uint32
+	isRoot  bool
+	region  fsutil.Region
+}
+
+// parentRef returns the cluster number that the ".." entries of the
+// table's subdirectories should refer to it by.
+func (t *dirTable) parentRef() uint32 {
+	if t.isRoot {
+		// The root directory is always referred to as cluster zero,
+		// regardless of where it really is.
+		return 0
+	}
+	return t.cluster
+}
+
+func (img *Image) rootTable() (*dirTable, error) {
+	if img.FATType != FAT32 {
+		return &dirTable{isRoot: true, region: img.root}, nil
+	}
+	region, err := img.chainRegion(img.RootCluster)
+	if err != nil {
+		return nil, err
+	}
+	return &dirTable{cluster: img.RootCluster, isRoot: true, region: region}, nil
+}
+
+// cleanImagePath returns the given slash-separated path in the form used
+// by Lookup, with no leading or trailing slashes.
+func cleanImagePath(name string) string {
+	return strings.Trim(path.Clean("/"+name), "/")
+}
+
+// parentTable finds the table of the directory that contains the given
+// path, and returns it along with the final element of the path, which
+// must be a valid long filename.
+func (img *Image) parentTable(op, name string) (*dirTable, string, error) {
+	clean := cleanImagePath(name)
+	dir, base := path.Split(clean)
+	dir = strings.TrimSuffix(dir, "/")
+	if err := validateLongName(base); err != nil {
+		return nil, "", &fs.PathError{Op: op, Path: name, Err: err}
+	}
+
+	if dir == "" {
+		table, err := img.rootTable()
+		if err != nil {
+			return nil, "", &fs.PathError{Op: op, Path: name, Err: err}
+		}
+		return table, base, nil
+	}
+
+	entry, err := img.Lookup(dir)
+	if err != nil {
+		return nil, "", &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	if !entry.IsDir() {
+		return nil, "", &fs.PathError{Op: op, Path: name, Err: errNotDir}
+	}
+	if entry.FirstCluster == 0 {
+		// Some implementations use cluster zero to refer to the root.
+		table, err := img.rootTable()
+		if err != nil {
+			return nil, "", &fs.PathError{Op: op, Path: name, Err: err}
+		}
+		return table, base, nil
+	}
+	region, err := img.chainRegion(entry.FirstCluster)
+	if err != nil {
+		return nil, "", &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return &dirTable{cluster: entry.FirstCluster, region: region}, base, nil
+}
+
+// validateLongName returns an error if the given name can't be used as a
+// long filename.
+func validateLongName(name string) error {
+	if name == "" || name == "." || name == ".." {
+		return fmt.Errorf("invalid name %q", name)
+	}
+	for _, c := range name {
+		if c < 0x20 || strings.ContainsRune(`"*/:<>?\|`, c) {
+			return fmt.Errorf("name %q contains invalid character %q", name, c)
+		}
+	}
+	if len(utf16.Encode([]rune(name))) > 255 {
+		return fmt.Errorf("name %q is longer than 255 characters", name)
+	}
+	return nil
+}
+
+// findSlot returns the slot whose name matches the given name, ignoring
+// case, or nil if there is none.
+func findSlot(slots []dirSlot, name string) *dirSlot {
+	for i := range slots {
+		if strings.EqualFold(slots[i].Name, name) {
+			return &slots[i]
+		}
+	}
+	return nil
+}
+
+// markDeleted marks all of the directory entries in the given slot,
+// including its long filename entries, as deleted.
+func markDeleted(table fsutil.Region, slot *dirSlot) {
+	for ofs := slot.start; ofs < slot.end; ofs += DirEntrySize {
+		table.WriteU8(ofs, deletedEntryMarker)
+	}
+}
+
+// addEntry adds an entry with the given name and details to the table,
+// which currently contains the given slots, choosing a short name that
+// differs from those of the slots and writing long filename entries if
+// necessary. The name and case flags of short are ignored.
+func (img *Image) addEntry(t *dirTable, slots []dirSlot, name string, short shortDirEntry) error {
+	taken := make(map[[11]byte]bool, len(slots))
+	for _, slot := range slots {
+		taken[slot.ShortName] = true
+	}
+	sn := chooseShortName(name, taken)
+	short.Name = sn.Name
+	short.CaseFlags = sn.CaseFlags
+
+	var lfnEntries []lfnDirEntry
+	if sn.NeedsLFN {
+		var err error
+		lfnEntries, err = makeLFNEntries(name, sn.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	raw := fsutil.RegionForBytes(make([]byte, (len(lfnEntries)+1)*DirEntrySize))
+	for i := range lfnEntries {
+		if err := raw.WriteStruct(i*DirEntrySize, &lfnEntries[i]); err != nil {
+			return err
+		}
+	}
+	if err := raw.WriteStruct(len(lfnEntries)*DirEntrySize, &short); err != nil {
+		return err
+	}
+
+	ofs, err := img.reserveEntries(t, len(lfnEntries)+1)
+	if err != nil {
+		return err
+	}
+	t.region.WriteBytes(ofs, raw.Bytes())
+	return nil
+}
+
+// reserveEntries finds space for the given number of consecutive entries
+// in the table, extending it if necessary, and returns the offset of the
+// first of them.
+func (img *Image) reserveEntries(t *dirTable, count int) (int, error) {
+	ofs, trailing, atEnd := findFreeEntries(t.region, count)
+	if ofs < 0 {
+		if t.cluster == 0 {
+			return 0, errRootFull
+		}
+
+		// We need more clusters, which will follow the free entries that
+		// are already at the end of the table.
+		chain, err := img.Chain(t.cluster)
+		if err != nil {
+			return 0, err
+		}
+		needed := uint32((count - trailing) * DirEntrySize)
+		added, err := img.allocClusters(divCeil(needed, uint32(img.clusterLen)), chain[len(chain)-1])
+		if err != nil {
+			return 0, err
+		}
+		for _, cluster := range added {
+			img.clearCluster(cluster)
+		}
+
+		t.region, err = img.chainRegion(t.cluster)
+		if err != nil {
+			return 0, err
+		}
+		ofs, _, atEnd = findFreeEntries(t.region, count)
+	}
+
+	if end := ofs + count*DirEntrySize; atEnd && end < t.region.Length() {
+		// The entries are taking the place of the end-of-directory marker,
+		// so we must write a new one after them.
+		t.region.WriteU8(end, 0x00)
+	}
+	return ofs, nil
+}
+
+// findFreeEntries finds the first run of the given number of free entries
+// in the table, returning its offset and whether it includes the
+// end-of-directory marker. If there is no such run, the offset is -1 and
+// trailing is the number of free entries at the end of the table.
+func findFreeEntries(table fsutil.Region, count int) (ofs, trailing int, atEnd bool) {
+	index := table.Indexed()
+	tableLen := index.Length()
+	runStart := 0
+	for entryOfs := 0; entryOfs+DirEntrySize <= tableLen; entryOfs += DirEntrySize {
+		switch index.ReadU8(entryOfs) {
+		case 0x00:
+			// Everything from here to the end of the table is free.
+			if tableLen-runStart >= count*DirEntrySize {
+				return runStart, 0, true
+			}
+			return -1, (tableLen - runStart) / DirEntrySize, false
+		case deletedEntryMarker:
+			if entryOfs+DirEntrySize-runStart >= count*DirEntrySize {
+				return runStart, 0, false
+			}
+		default:
+			runStart = entryOfs + DirEntrySize
+		}
+	}
+	return -1, (tableLen - runStart) / DirEntrySize, false
+}
+
+// clusterRegion returns the region covering the given cluster.
+func (img *Image) clusterRegion(cluster uint32) fsutil.Region {
+	return img.data.Slice(int(cluster-2)*img.clusterLen, img.clusterLen)
+}
+
+// clearCluster sets all of the bytes in the given cluster to zero.
+func (img *Image) clearCluster(cluster uint32) {
+	region := img.clusterRegion(cluster)
+	region.WriteBytes(0, make([]byte, img.clusterLen))
+}
+
+// setFATEntry sets the entry for the given cluster in every copy of the
+// FAT.
+func (img *Image) setFATEntry(cluster uint32, val uint32) {
+	for _, fat := range img.fats {
+		img.FATType.writeEntry(fat, cluster, val)
+	}
+}
+
+// resizeChain changes the length of the chain beginning at the given
+// cluster, which may be zero for an empty chain, to the given number of
+// clusters, returning the first cluster of the resulting chain.
+//
+// Any clusters that are added are not cleared.
+func (img *Image) resizeChain(start uint32, count uint32) (uint32, error) {
+	var chain []uint32
+	if start != 0 {
+		var err error
+		chain, err = img.Chain(start)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	switch {
+	case count == 0:
+		img.freeClusters(chain)
+		return 0, nil
+	case len(chain) == 0:
+		added, err := img.allocClusters(count, 0)
+		if err != nil {
+			return 0, err
+		}
+		return added[0], nil
+	case uint32(len(chain)) >= count:
+		img.setFATEntry(chain[count-1], img.FATType.endOfChain())
+		img.freeClusters(chain[count:])
+		return start, nil
+	default:
+		_, err := img.allocClusters(count-uint32(len(chain)), chain[len(chain)-1])
+		return start, err
+	}
+}
+
+// allocClusters allocates a chain of the given number of free clusters,
+// appending it to the chain that ends with the given cluster, if that is
+// not zero. It returns the newly-allocated clusters, in order.
+//
+// If there are not enough free clusters, nothing is allocated.
+func (img *Image) allocClusters(count uint32, after uint32) ([]uint32, error) {
+	// The FSInfo hint tells us where to start looking. We keep it set to
+	// the first free cluster, as Build does, but other implementations
+	// may use it differently.
+	start := uint32(2)
+	if img.validCluster(img.NextFreeCluster) {
+		start = img.NextFreeCluster
+	}
+
+	clusters := make([]uint32, 0, count)
+	for i := uint32(0); i < img.ClusterCount && uint32(len(clusters)) < count; i++ {
+		cluster := 2 + (start-2+i)%img.ClusterCount
+		if img.FATEntry(cluster) == 0 {
+			clusters = append(clusters, cluster)
+		}
+	}
+	if uint32(len(clusters)) < count {
+		return nil, errNoSpace
+	}
+
+	for i, cluster := range clusters {
+		next := img.FATType.endOfChain()
+		if i+1 < len(clusters) {
+			next = clusters[i+1]
+		}
+		img.setFATEntry(cluster, next)
+	}
+	if after != 0 {
+		img.setFATEntry(after, clusters[0])
+	}
+
+	img.updateFSInfo(-int64(count), img.nextFreeCluster(clusters[len(clusters)-1]))
+	return clusters, nil
+}
+
+// freeClusters marks the given clusters as free.
+func (img *Image) freeClusters(clusters []uint32) {
+	if len(clusters) == 0 {
+		return
+	}
+	next := img.NextFreeCluster
+	for _, cluster := range clusters {
+		img.setFATEntry(cluster, 0)
+		if !img.validCluster(next) || cluster < next {
+			next = cluster
+		}
+	}
+	img.updateFSInfo(int64(len(clusters)), next)
+}
+
+// nextFreeCluster returns the first free cluster after the given one,
+// wrapping around to the start of the data area if necessary, or
+// 0xffffffff if there are no free clusters.
+func (img *Image) nextFreeCluster(after uint32) uint32 {
+	for i := uint32(1); i <= img.ClusterCount; i++ {
+		cluster := 2 + (after-2+i)%img.ClusterCount
+		if img.FATEntry(cluster) == 0 {
+			return cluster
+		}
+	}
+	return 0xffffffff
+}
+
+// updateFSInfo adjusts the free cluster count by the given amount, unless
+// it is unknown, and sets the next free cluster hint, writing both to the
+// FSInfo sector if there is one.
+func (img *Image) updateFSInfo(freeDelta int64, next uint32) {
+	if img.FreeClusterCount != 0xffffffff {
+		img.FreeClusterCount = uint32(int64(img.FreeClusterCount) + freeDelta)
+	}
+	img.NextFreeCluster = next
+
+	if img.fsInfo == nil {
+		return
+	}
+	var info fsInfoSectorFields
+	if err := img.fsInfo.ReadStruct(0, &info); err != nil {
+		return
+	}
+	info.FreeClusterCount = img.FreeClusterCount
+	info.NextFreeCluster = img.NextFreeCluster
+	img.fsInfo.WriteStruct(0, &info)
+}
@@ -0,0 +1,239 @@
+package vfat
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"testing"
+	"time"
+
+	"github.com/apparentlymart/go-fsutil/fsutil"
+)
+
+func TestImageModify(t *testing.T) {
+	modTime := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	body := func(b []byte) fsutil.RegionBuilder {
+		return &fsutil.BufferRegionBuilder{Buffer: b}
+	}
+	longBody := bytes.Repeat([]byte("long"), 700)
+
+	for _, fatType := range []FATType{FAT16, FAT32} {
+		t.Run(fatType.String(), func(t *testing.T) {
+			img := buildTestImage(t, &Filesystem{
+				FATType:           fatType,
+				ClusterSize:       512,
+				ExtraClusterCount: 256,
+				RootDir: &Directory{
+					Dirs: []DirEntryDir{
+						{
+							DirEntryCommon: DirEntryCommon{Name: "sub"},
+							Directory: &Directory{
+								Files: []DirEntryFile{
+									{
+										DirEntryCommon: DirEntryCommon{Name: "old.txt"},
+										BodyBuilder:    body([]byte("old")),
+									},
+								},
+							},
+						},
+					},
+					Files: []DirEntryFile{
+						{
+							DirEntryCommon: DirEntryCommon{Name: "keep.txt"},
+							BodyBuilder:    body(bytes.Repeat([]byte("k"), 1500)),
+						},
+						{
+							DirEntryCommon: DirEntryCommon{Name: "gone.txt"},
+							BodyBuilder:    body([]byte("gone")),
+						},
+					},
+				},
+			})
+			initialFree, _ := img.FreeSpace()
+
+			steps := []func() error{
+				func() error { return img.WriteFile("sub/A file with a long name.txt", body(longBody), modTime) },
+				func() error { return img.WriteFile("KEEP.TXT", body([]byte("shorter")), modTime) },
+				func() error { return img.Remove("gone.txt") },
+				func() error { return img.Mkdir("newdir", modTime) },
+				func() error { return img.Rename("sub/old.txt", "newdir/Renamed.txt") },
+				func() error { return img.Rename("sub", "newdir/moved") },
+			}
+			// Enough entries to need more than one cluster of table.
+			for i := 0; i < 20; i++ {
+				name := fmt.Sprintf("newdir/moved/generated file %02d.txt", i)
+				steps = append(steps, func() error {
+					return img.WriteFile(name, body([]byte(name)), modTime)
+				})
+			}
+			for i, step := range steps {
+				if err := step(); err != nil {
+					t.Fatalf("step %d failed: %s", i, err)
+				}
+			}
+
+			// We'll check the result through a fresh Image, to make sure
+			// that everything was written to the region.
+			img, err := Open(img.region)
+			if err != nil {
+				t.Fatalf("failed to reopen image: %s", err)
+			}
+			ifs := img.FS()
+			want := map[string][]byte{
+				"keep.txt":           []byte("shorter"),
+				"newdir/Renamed.txt": []byte("old"),
+				"newdir/moved/A file with a long name.txt": longBody,
+				"newdir/moved/generated file 19.txt":       []byte("newdir/moved/generated file 19.txt"),
+			}
+			for name, want := range want {
+				got, err := ifs.ReadFile(name)
+				if err != nil {
+					t.Errorf("failed to read %s: %s", name, err)
+					continue
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("%s contains %q; want %q", name, got, want)
+				}
+			}
+			for _, name := range []string{"gone.txt", "sub", "sub/old.txt"} {
+				if _, err := img.Lookup(name); !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("%s still exists", name)
+				}
+			}
+
+			entries, err := ifs.ReadDir("newdir/moved")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := len(entries), 21; got != want {
+				t.Errorf("newdir/moved has %d entries; want %d", got, want)
+			}
+
+			// The moved directory's ".." entry must refer to its new parent.
+			newdir, err := img.Lookup("newdir")
+			if err != nil {
+				t.Fatal(err)
+			}
+			moved, err := img.Lookup("newdir/moved")
+			if err != nil {
+				t.Fatal(err)
+			}
+			table, err := img.chainRegion(moved.FirstCluster)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var dotDot shortDirEntry
+			table.ReadStruct(DirEntrySize, &dotDot)
+			if got, want := dotDot.cluster(), newdir.FirstCluster; got != want {
+				t.Errorf("moved directory's parent is cluster %d; want %d", got, want)
+			}
+
+			for i := 1; i < len(img.fats); i++ {
+				if !bytes.Equal(img.fats[i].Bytes(), img.fat.Bytes()) {
+					t.Errorf("FAT %d differs from the first FAT", i)
+				}
+			}
+
+			// Every cluster should either be free or belong to exactly
+			// one chain that is reachable from the root directory.
+			used := countUsedClusters(t, img)
+			if got, _ := img.FreeSpace(); int(got) != int(img.ClusterCount)-used {
+				t.Errorf("FAT has %d free clusters; want %d (started with %d)", got, int(img.ClusterCount)-used, initialFree)
+			}
+			for _, d := range img.VerifyFSInfo() {
+				t.Errorf("FSInfo is inconsistent: %s", d)
+			}
+		})
+	}
+}
+
+func TestImageModifyErrors(t *testing.T) {
+	img := buildTestImage(t, &Filesystem{
+		ExtraClusterCount: 2,
+		RootDir: &Directory{
+			Dirs: []DirEntryDir{
+				{
+					DirEntryCommon: DirEntryCommon{Name: "full"},
+					Directory: &Directory{
+						Files: []DirEntryFile{
+							{
+								DirEntryCommon: DirEntryCommon{Name: "f"},
+								BodyBuilder:    &fsutil.BufferRegionBuilder{Buffer: []byte("f")},
+							},
+						},
+					},
+				},
+			},
+		},
+	})
+	empty := &fsutil.BufferRegionBuilder{}
+	huge := &fsutil.ZeroRegionBuilder{Size: int(img.ClusterCount+1) * img.clusterLen}
+
+	tests := []struct {
+		err  error
+		want error
+	}{
+		{img.Mkdir("full", time.Time{}), fs.ErrExist},
+		{img.Remove("missing"), fs.ErrNotExist},
+		{img.Remove("full"), errNotEmpty},
+		{img.WriteFile("full", empty, time.Time{}), errIsDir},
+		{img.WriteFile("full/f/g", empty, time.Time{}), errNotDir},
+		{img.WriteFile("huge", huge, time.Time{}), errNoSpace},
+		{img.Rename("full", "full/inside"), fs.ErrInvalid},
+		{img.Rename("full/f", "full"), fs.ErrExist},
+	}
+	for i, test := range tests {
+		if !errors.Is(test.err, test.want) {
+			t.Errorf("test %d returned %v; want %v", i, test.err, test.want)
+		}
+	}
+
+	if _, err := img.Lookup("huge"); err == nil {
+		t.Errorf("failed write created a file")
+	}
+}
+
+// countUsedClusters returns the number of clusters in the chains reachable
+// from the root directory, failing the test if any cluster is used twice.
+func countUsedClusters(t *testing.T, img *Image) int {
+	seen := map[uint32]bool{}
+	addChain := func(start uint32) {
+		chain, err := img.Chain(start)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, cluster := range chain {
+			if seen[cluster] {
+				t.Fatalf("cluster %d is used more than once", cluster)
+			}
+			seen[cluster] = true
+		}
+	}
+
+	if img.FATType == FAT32 {
+		addChain(img.RootCluster)
+	}
+	var walk func(entries []ImageEntry)
+	walk = func(entries []ImageEntry) {
+		for i := range entries {
+			entry := &entries[i]
+			if entry.FirstCluster != 0 {
+				addChain(entry.FirstCluster)
+			}
+			if entry.IsDir() {
+				children, err := img.ReadDir(entry)
+				if err != nil {
+					t.Fatal(err)
+				}
+				walk(children)
+			}
+		}
+	}
+	root, err := img.ReadRootDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	walk(root)
+	return len(seen)
+}
@@ -0,0 +1,119 @@
+package vfat
+
+// The structures below describe the layout of the on-disk structures, for
+// use with the ReadStruct and WriteStruct methods of fsutil.Region. Offsets
+// are relative to the start of the sector or entry containing them.
+
+// biosParameterBlock is the part of the boot record that is common to all
+// FAT types. Of each pair of 16-bit and 32-bit fields, only one is used.
+type biosParameterBlock struct {
+	BytesPerSector    uint16 `region:"0x00b"`
+	SectorsPerCluster uint8  `region:"0x00d"`
+	ReservedSectors   uint16 `region:"0x00e"`
+	FATCount          uint8  `region:"0x010"`
+	RootEntryCount    uint16 `region:"0x011"`
+	TotalSectors16    uint16 `region:"0x013"`
+	MediaDescriptor   uint8  `region:"0x015"`
+	SectorsPerFAT16   uint16 `region:"0x016"`
+	SectorsPerTrack   uint16 `region:"0x018"`
+	HeadCount         uint16 `region:"0x01a"`
+	HiddenSectors     uint32 `region:"0x01c"`
+	TotalSectors32    uint32 `region:"0x020"`
+}
+
+// fat32ParameterBlock follows the common part of the BPB on FAT32 only.
+type fat32ParameterBlock struct {
+	SectorsPerFAT    uint32 `region:"0x024"`
+	Flags            uint16 `region:"0x028"`
+	Version          uint16 `region:"0x02a"`
+	RootCluster      uint32 `region:"0x02c"`
+	FSInfoSector     uint16 `region:"0x030"`
+	BackupBootSector uint16 `region:"0x032"`
+}
+
+// extendedParameterBlock follows the BPB, at offset 0x024 on FAT12 and
+// FAT16 or 0x040 on FAT32.
+type extendedParameterBlock struct {
+	DriveNumber uint8    `region:"0x00"`
+	Signature   uint8    `region:"0x02"`
+	VolumeID    uint32   `region:"0x03"`
+	Label       [11]byte `region:"0x07"`
+	FSType      [8]byte  `region:"0x12"`
+}
+
+// extendedParameterBlockOffset returns the offset of the extended BPB in
+// the boot record of a filesystem of the given type.
+func extendedParameterBlockOffset(fatType FATType) int {
+	if fatType == FAT32 {
+		return 0x040
+	}
+	return 0x024
+}
+
+// fsInfoSectorFields is the layout of the FAT32 FSInfo sector.
+type fsInfoSectorFields struct {
+	Signature1       [4]byte `region:"0x000"`
+	Signature2       [4]byte `region:"0x1e4"`
+	FreeClusterCount uint32  `region:"0x1e8"`
+	NextFreeCluster  uint32  `region:"0x1ec"`
+	Signature3       [4]byte `region:"0x1fc"`
+}
+
+// shortDirEntry is the layout of a directory entry that describes a file
+// or directory, or the volume label.
+type shortDirEntry struct {
+	Name          [11]byte `region:"0x00"`
+	Attributes    uint8    `region:"0x0b"`
+	CaseFlags     uint8    `region:"0x0c"`
+	CreationTenMs uint8    `region:"0x0d"`
+	CreationTime  uint16   `region:"0x0e"`
+	CreationDate  uint16   `region:"0x10"`
+	AccessDate    uint16   `region:"0x12"`
+	ClusterHigh   uint16   `region:"0x14"`
+	ModifiedTime  uint16   `region:"0x16"`
+	ModifiedDate  uint16   `region:"0x18"`
+	ClusterLow    uint16   `region:"0x1a"`
+	Size          uint32   `region:"0x1c"`
+}
+
+func (e *shortDirEntry) cluster() uint32 {
+	return uint32(e.ClusterHigh)<<16 | uint32(e.ClusterLow)
+}
+
+func (e *shortDirEntry) setCluster(cluster uint32) {
+	e.ClusterHigh = uint16(cluster >> 16)
+	e.ClusterLow = uint16(cluster)
+}
+
+// lfnDirEntry is the layout of a directory entry that holds part of a long
+// filename. Its 13 little-endian UCS-2 characters are split over three
+// fields.
+type lfnDirEntry struct {
+	Sequence   uint8    `region:"0x00"`
+	Chars1     [10]byte `region:"0x01"`
+	Attributes uint8    `region:"0x0b"`
+	Type       uint8    `region:"0x0c"`
+	Checksum   uint8    `region:"0x0d"`
+	Chars2     [12]byte `region:"0x0e"`
+	Cluster    uint16   `region:"0x1a"`
+	Chars3     [4]byte  `region:"0x1c"`
+}
+
+// chars returns the characters stored in the entry.
+func (e *lfnDirEntry) chars() []uint16 {
+	chars := make([]uint16, 0, 13)
+	for _, field := range [][]byte{e.Chars1[:], e.Chars2[:], e.Chars3[:]} {
+		for i := 0; i < len(field); i += 2 {
+			chars = append(chars, uint16(field[i])|uint16(field[i+1])<<8)
+		}
+	}
+	return chars
+}
+
+// setChars stores the given lfnEntryBytes bytes of encoded characters in
+// the entry.
+func (e *lfnDirEntry) setChars(chars []byte) {
+	copy(e.Chars1[:], chars[0:10])
+	copy(e.Chars2[:], chars[10:22])
+	copy(e.Chars3[:], chars[22:26])
+}
@@ -0,0 +1,142 @@
+package vfat
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/apparentlymart/go-fsutil/fsutil"
+)
+
+// reproducible returns the filesystem that Build should actually write,
+// which is the receiver itself unless Reproducible is set. Otherwise it's
+// a copy with its entries sorted, its timestamps clamped and its VolumeID
+// derived from its content, as described for Reproducible.
+//
+// None of these changes affect the layout, so the copy has the same
+// layout as the receiver.
+func (fs *Filesystem) reproducible() (*Filesystem, error) {
+	if !fs.Reproducible {
+		return fs, nil
+	}
+
+	ret := *fs
+	if ret.Location == nil {
+		// Otherwise the result would depend on the time zone of each
+		// timestamp, which usually comes from the local environment.
+		ret.Location = time.UTC
+	}
+
+	sourceDate := fs.SourceDate
+	if sourceDate.IsZero() {
+		var err error
+		sourceDate, err = sourceDateEpoch()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if sourceDate.IsZero() {
+		// Without a source date every timestamp becomes the earliest
+		// that can be recorded, since otherwise the result would depend
+		// on when the content was last modified.
+		sourceDate, _ = dosTimeRange(ret.Location)
+	}
+
+	ret.RootDir = reproducibleDirectory(fs.RootDir, sourceDate)
+	if ret.VolumeID == 0 {
+		h := sha256.New()
+		fmt.Fprintf(h, "%q\n", ret.Label)
+		if err := ret.hashDirectory(h, ret.RootDir); err != nil {
+			return nil, err
+		}
+		ret.VolumeID = binary.LittleEndian.Uint32(h.Sum(nil))
+	}
+	return &ret, nil
+}
+
+// sourceDateEpoch returns the time given in the SOURCE_DATE_EPOCH
+// environment variable, or the zero time if it isn't set.
+func sourceDateEpoch() (time.Time, error) {
+	v := os.Getenv("SOURCE_DATE_EPOCH")
+	if v == "" {
+		return time.Time{}, nil
+	}
+	secs, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("SOURCE_DATE_EPOCH %q is not a whole number of seconds", v)
+	}
+	return time.Unix(secs, 0).UTC(), nil
+}
+
+// reproducibleDirectory returns a copy of the given directory tree with
+// the entries of each directory sorted by name, and with any timestamps
+// later than the given source date clamped to it.
+func reproducibleDirectory(dir *Directory, sourceDate time.Time) *Directory {
+	ret := &Directory{
+		Dirs:  make([]DirEntryDir, len(dir.Dirs)),
+		Files: make([]DirEntryFile, len(dir.Files)),
+	}
+	for i, entry := range dir.Dirs {
+		entry.DirEntryCommon = entry.clamped(sourceDate)
+		entry.Directory = reproducibleDirectory(entry.Directory, sourceDate)
+		ret.Dirs[i] = entry
+	}
+	for i, entry := range dir.Files {
+		entry.DirEntryCommon = entry.clamped(sourceDate)
+		ret.Files[i] = entry
+	}
+	sort.Slice(ret.Dirs, func(i, j int) bool {
+		return ret.Dirs[i].Name < ret.Dirs[j].Name
+	})
+	sort.Slice(ret.Files, func(i, j int) bool {
+		return ret.Files[i].Name < ret.Files[j].Name
+	})
+	return ret
+}
+
+func (e DirEntryCommon) clamped(sourceDate time.Time) DirEntryCommon {
+	for _, t := range []*time.Time{&e.CreationTime, &e.LastAccessedTime, &e.LastModifiedTime} {
+		if t.After(sourceDate) {
+			*t = sourceDate
+		}
+	}
+	return e
+}
+
+// hashDirectory writes a description of everything in the given directory
+// tree that affects the filesystem's content, including the file bodies,
+// to the given hash. Timestamps are described by the directory entry fields
+// they're recorded in, so that differences too small to record don't count.
+func (fs *Filesystem) hashDirectory(h hash.Hash, dir *Directory) error {
+	hashCommon := func(kind string, e DirEntryCommon) {
+		created, createdTOD, createdTenMillis, _ := encodeDOSTime(e.CreationTime, fs.Location)
+		accessed, _, _, _ := encodeDOSTime(e.LastAccessedTime, fs.Location)
+		modified, modifiedTOD, _, _ := encodeDOSTime(e.LastModifiedTime, fs.Location)
+		fmt.Fprintf(
+			h, "%s %q %d %04x %04x %02x %04x %04x %04x\n",
+			kind, e.Name, e.Attributes,
+			created, createdTOD, createdTenMillis, accessed, modified, modifiedTOD,
+		)
+	}
+
+	for _, entry := range dir.Dirs {
+		hashCommon("dir", entry.DirEntryCommon)
+		if err := fs.hashDirectory(h, entry.Directory); err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "end\n")
+	}
+	for _, entry := range dir.Files {
+		hashCommon("file", entry.DirEntryCommon)
+		fmt.Fprintf(h, "%d\n", entry.BodyBuilder.Length())
+		if _, err := fsutil.BuildTo(h, entry.BodyBuilder); err != nil {
+			return fmt.Errorf("failed to build %s: %w", entry.Name, err)
+		}
+	}
+	return nil
+}
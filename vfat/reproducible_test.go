@@ -0,0 +1,191 @@
+package vfat
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/apparentlymart/go-fsutil/fsutil"
+)
+
+func TestReproducible(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "1700000000")
+	sourceDate := time.Unix(1700000000, 0)
+
+	// Each build gets the same content, but in a different order, with
+	// different timestamps after the source date, and in a region with
+	// different garbage in it.
+	build := func(modTime time.Time, reverse bool, garbage byte) []byte {
+		common := func(name string) DirEntryCommon {
+			return DirEntryCommon{
+				Name:             name,
+				CreationTime:     modTime,
+				LastAccessedTime: modTime,
+				LastModifiedTime: modTime,
+			}
+		}
+		files := []DirEntryFile{
+			{DirEntryCommon: common("b.txt"), BodyBuilder: &fsutil.BufferRegionBuilder{Buffer: []byte("b")}},
+			{DirEntryCommon: common("a long name.txt"), BodyBuilder: &fsutil.BufferRegionBuilder{Buffer: []byte("a")}},
+			{DirEntryCommon: common("C.TXT"), BodyBuilder: &fsutil.BufferRegionBuilder{}},
+		}
+		dirs := []DirEntryDir{
+			{DirEntryCommon: common("sub2"), Directory: &Directory{}},
+			{DirEntryCommon: common("sub1"), Directory: &Directory{Files: files[:1]}},
+		}
+		if reverse {
+			files = []DirEntryFile{files[2], files[1], files[0]}
+			dirs = []DirEntryDir{dirs[1], dirs[0]}
+		}
+		fs := &Filesystem{
+			FATType:           FAT32,
+			ClusterSize:       512,
+			ExtraClusterCount: 10,
+			Reproducible:      true,
+			RootDir:           &Directory{Dirs: dirs, Files: files},
+		}
+
+		buf := bytes.Repeat([]byte{garbage}, fs.Length())
+		if err := fs.Build(fsutil.RegionForBytes(buf)); err != nil {
+			t.Fatalf("failed to build filesystem: %s", err)
+		}
+
+		var streamed bytes.Buffer
+		if _, err := fsutil.BuildTo(&streamed, fs); err != nil {
+			t.Fatalf("failed to stream filesystem: %s", err)
+		}
+		if sha256.Sum256(streamed.Bytes()) != sha256.Sum256(buf) {
+			t.Errorf("streamed filesystem differs from built filesystem")
+		}
+		return buf
+	}
+
+	first := build(sourceDate.Add(time.Hour), false, 0xa5)
+	second := build(sourceDate.Add(48*time.Hour), true, 0x5a)
+	if sha256.Sum256(first) != sha256.Sum256(second) {
+		t.Fatalf("filesystems differ")
+	}
+
+	img, err := Open(fsutil.RegionForBytes(first))
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeID := img.VolumeID
+	if volumeID == 0 {
+		t.Errorf("VolumeID is zero; want one derived from the content")
+	}
+	entries, err := img.ReadRootDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name)
+		if !entry.LastModifiedTime.Equal(sourceDate) {
+			t.Errorf("%s was last modified at %s; want %s", entry.Name, entry.LastModifiedTime, sourceDate)
+		}
+	}
+	if got, want := names, []string{"sub1", "sub2", "C.TXT", "a long name.txt", "b.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("root directory contains %q; want %q", got, want)
+	}
+
+	// Timestamps before the source date are kept.
+	earlier := build(sourceDate.Add(-time.Hour), false, 0)
+	if bytes.Equal(first, earlier) {
+		t.Errorf("filesystem with earlier timestamps is the same")
+	}
+	img, err = Open(fsutil.RegionForBytes(earlier))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.VolumeID == 0 || img.VolumeID == volumeID {
+		t.Errorf("VolumeID 0x%08x does not depend on the content", img.VolumeID)
+	}
+}
+
+func TestReproducibleWithoutSourceDate(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "")
+
+	build := func(modTime time.Time) []byte {
+		fs := &Filesystem{
+			Reproducible: true,
+			RootDir: &Directory{
+				Files: []DirEntryFile{
+					{
+						DirEntryCommon: DirEntryCommon{Name: "a.txt", LastModifiedTime: modTime},
+						BodyBuilder:    &fsutil.BufferRegionBuilder{Buffer: []byte("a")},
+					},
+				},
+			},
+		}
+		buf := make([]byte, fs.Length())
+		if err := fs.Build(fsutil.RegionForBytes(buf)); err != nil {
+			t.Fatalf("failed to build filesystem: %s", err)
+		}
+		return buf
+	}
+
+	first := build(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	second := build(time.Date(2024, 6, 30, 12, 0, 0, 0, time.UTC))
+	if sha256.Sum256(first) != sha256.Sum256(second) {
+		t.Fatalf("filesystems differ")
+	}
+
+	img, err := Open(fsutil.RegionForBytes(first))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := img.Lookup("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := entry.LastModifiedTime, time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("a.txt was last modified at %s; want %s", got, want)
+	}
+}
+
+func TestReproducibleVolumeIDPrecision(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "4000000000")
+
+	// Last modified times are recorded to the nearest two seconds, so
+	// these differ only in what isn't recorded.
+	volumeID := func(modTime time.Time) uint32 {
+		fs := &Filesystem{
+			Reproducible: true,
+			RootDir: &Directory{
+				Files: []DirEntryFile{
+					{
+						DirEntryCommon: DirEntryCommon{Name: "a.txt", LastModifiedTime: modTime},
+						BodyBuilder:    &fsutil.BufferRegionBuilder{Buffer: []byte("a")},
+					},
+				},
+			},
+		}
+		buf := make([]byte, fs.Length())
+		if err := fs.Build(fsutil.RegionForBytes(buf)); err != nil {
+			t.Fatalf("failed to build filesystem: %s", err)
+		}
+		img, err := Open(fsutil.RegionForBytes(buf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return img.VolumeID
+	}
+
+	modTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	first := volumeID(modTime)
+	second := volumeID(modTime.Add(1500 * time.Millisecond))
+	if first != second {
+		t.Errorf("VolumeIDs 0x%08x and 0x%08x differ", first, second)
+	}
+}
+
+func TestSourceDateEpochInvalid(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "yesterday")
+	fs := &Filesystem{Reproducible: true, RootDir: &Directory{}}
+	if err := fs.Build(fsutil.RegionForBytes(make([]byte, fs.Length()))); err == nil {
+		t.Errorf("succeeded with invalid SOURCE_DATE_EPOCH; want error")
+	}
+}
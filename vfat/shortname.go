@@ -0,0 +1,243 @@
+package vfat
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Flags recorded at offset 0x0c of a directory entry to indicate that
+// an 8.3 name should be displayed in lowercase, which allows names like
+// "readme.txt" to be stored without any LFN entries.
+const (
+	lowerBaseFlag byte = 0x08
+	lowerExtFlag  byte = 0x10
+)
+
+// shortNameSpecials are the non-alphanumeric characters that may appear
+// in an 8.3 name.
+const shortNameSpecials = "$%'-_@~`!(){}^#&"
+
+// shortName is the 8.3 name chosen for a directory entry.
+type shortName struct {
+	Name      [11]byte
+	CaseFlags byte
+
+	// NeedsLFN is true if the entry's name cannot be represented exactly
+	// by the 8.3 name, and so LFN entries must be written for it.
+	NeedsLFN bool
+}
+
+// shortNames chooses a unique 8.3 name for each entry in the directory,
+// giving subdirectories first and then files, in the order they are
+// written to the directory table.
+func (d *Directory) shortNames() []shortName {
+	entries := d.entries()
+	ret := make([]shortName, len(entries))
+	taken := make(map[[11]byte]bool, len(entries))
+	var pending []int
+
+	// Names that are already valid 8.3 names get first claim on them, so
+	// that the numeric tails we generate for other names can't take them.
+	for i, entry := range entries {
+		sn, exact := exactShortName(entry.Name)
+		if !exact || taken[sn.Name] {
+			pending = append(pending, i)
+			continue
+		}
+		ret[i] = sn
+		taken[sn.Name] = true
+	}
+
+	for _, i := range pending {
+		sn := tailedShortName(entries[i].Name, taken)
+		ret[i] = sn
+		taken[sn.Name] = true
+	}
+
+	return ret
+}
+
+// chooseShortName chooses an 8.3 name for a single new entry with the
+// given name, which must differ from all of the names already taken.
+func chooseShortName(name string, taken map[[11]byte]bool) shortName {
+	if sn, exact := exactShortName(name); exact && !taken[sn.Name] {
+		return sn
+	}
+	return tailedShortName(name, taken)
+}
+
+// tailedShortName generates an 8.3 name for the given name that differs
+// from all of the names already taken, adding a numeric tail if necessary.
+// The result always needs LFN entries.
+func tailedShortName(name string, taken map[[11]byte]bool) shortName {
+	base, ext, lossy := basisName(name)
+	sn := shortName{NeedsLFN: true}
+	if len(ext) > 3 {
+		ext = ext[:3]
+		lossy = true
+	}
+
+	if !lossy && len(base) <= 8 {
+		// The name fits, but differs by case in a way that can't be
+		// represented by the case flags, so we just need an LFN.
+		copy(sn.Name[:], padShortName(base, ext))
+		if !taken[sn.Name] {
+			return sn
+		}
+	}
+
+	tailed := func(tailBase string, n int) bool {
+		tail := "~" + strconv.Itoa(n)
+		if len(tailBase) > 8-len(tail) {
+			tailBase = tailBase[:8-len(tail)]
+		}
+		copy(sn.Name[:], padShortName(tailBase+tail, ext))
+		return !taken[sn.Name]
+	}
+
+	// As in other implementations, only the first few tails are tried
+	// on the basis name itself. After that, the basis is mostly replaced
+	// by a hash of the long name, so that a directory with many names
+	// sharing a basis doesn't need to try every tail for each of them.
+	for n := 1; n <= maxNumericTail; n++ {
+		if tailed(base, n) {
+			return sn
+		}
+	}
+	if len(base) > 2 {
+		base = base[:2]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	sum := h.Sum32()
+	hashed := base + fmt.Sprintf("%04X", (sum>>16^sum)&0xffff)
+	for n := 1; !tailed(hashed, n); n++ {
+	}
+	return sn
+}
+
+// maxNumericTail is the largest numeric tail tried on a basis name before
+// tailedShortName switches to a hashed basis.
+const maxNumericTail = 4
+
+// exactShortName returns the 8.3 name that represents the given name
+// exactly, without any LFN entries, or false if there is no such name.
+func exactShortName(name string) (shortName, bool) {
+	var sn shortName
+
+	base, ext := name, ""
+	dot := strings.IndexByte(name, '.')
+	if dot >= 0 {
+		base, ext = name[:dot], name[dot+1:]
+	}
+	if len(base) < 1 || len(base) > 8 || len(ext) > 3 || (dot >= 0 && ext == "") {
+		return sn, false
+	}
+
+	baseFlag, ok := shortNamePartCase(base, lowerBaseFlag)
+	if !ok {
+		return sn, false
+	}
+	extFlag, ok := shortNamePartCase(ext, lowerExtFlag)
+	if !ok {
+		return sn, false
+	}
+
+	copy(sn.Name[:], padShortName(strings.ToUpper(base), strings.ToUpper(ext)))
+	sn.CaseFlags = baseFlag | extFlag
+	return sn, true
+}
+
+// shortNamePartCase checks that one part of a name contains only valid
+// 8.3 characters and is all in one case, returning the given flag if that
+// case is lowercase.
+func shortNamePartCase(part string, lowerFlag byte) (byte, bool) {
+	hasUpper, hasLower := false, false
+	for _, c := range part {
+		switch {
+		case c >= 'A' && c <= 'Z':
+			hasUpper = true
+		case c >= 'a' && c <= 'z':
+			hasLower = true
+		case c >= '0' && c <= '9':
+		case strings.ContainsRune(shortNameSpecials, c):
+		default:
+			return 0, false
+		}
+	}
+	switch {
+	case hasUpper && hasLower:
+		return 0, false
+	case hasLower:
+		return lowerFlag, true
+	default:
+		return 0, true
+	}
+}
+
+// basisName derives the uppercase base and extension that an 8.3 name for
+// the given long name should be based on, before any truncation. lossy is
+// true if characters had to be removed or replaced to produce it.
+func basisName(name string) (base, ext string, lossy bool) {
+	// Spaces are not used in generated names, and leading periods would
+	// otherwise produce an empty base name.
+	stripped := strings.TrimLeft(strings.Replace(name, " ", "", -1), ".")
+	if stripped != name {
+		lossy = true
+	}
+
+	// The extension comes after the last period, and any other periods
+	// are dropped from the base.
+	if dot := strings.LastIndexByte(stripped, '.'); dot >= 0 {
+		base, ext = stripped[:dot], stripped[dot+1:]
+		if strings.Contains(base, ".") {
+			base = strings.Replace(base, ".", "", -1)
+			lossy = true
+		}
+	} else {
+		base = stripped
+	}
+
+	base, baseLossy := oemName(base)
+	ext, extLossy := oemName(ext)
+	lossy = lossy || baseLossy || extLossy
+	if base == "" {
+		base = "_"
+		lossy = true
+	}
+	return base, ext, lossy
+}
+
+// oemName converts a part of a name into uppercase characters that are
+// valid in 8.3 names, replacing any others with underscores.
+//
+// We don't know which OEM code page will be used to interpret the
+// names, so only ASCII characters are retained.
+func oemName(part string) (string, bool) {
+	lossy := false
+	ret := make([]byte, 0, len(part))
+	for _, c := range part {
+		c = unicode.ToUpper(c)
+		switch {
+		case c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune(shortNameSpecials, c):
+		default:
+			c = '_'
+			lossy = true
+		}
+		ret = append(ret, byte(c))
+	}
+	return string(ret), lossy
+}
+
+// padShortName pads a base and extension with spaces to produce the
+// 11-byte form used in directory entries.
+func padShortName(base, ext string) []byte {
+	ret := []byte("           ")
+	copy(ret[0:8], base)
+	copy(ret[8:11], ext)
+	return ret
+}
@@ -0,0 +1,80 @@
+package vfat
+
+import (
+	"fmt"
+	"regexp"
+	"testing"
+)
+
+func TestShortNames(t *testing.T) {
+	type test struct {
+		name     string
+		expected string
+		flags    byte
+		needsLFN bool
+	}
+
+	tests := []test{
+		{"INDEX.HTM", "INDEX   HTM", 0x00, false},
+		{"readme.txt", "README  TXT", 0x18, false},
+		{"Makefile", "MAKEFILE   ", 0x00, true},
+		{"makefile.IN", "MAKEFILEIN ", 0x08, false},
+		{"FOO~1.TXT", "FOO~1   TXT", 0x00, false},
+		{"foo bar.txt", "FOOBAR~1TXT", 0x00, true},
+		{"foo.bar.txt", "FOOBAR~2TXT", 0x00, true},
+		{"a+b.jpeg", "A_B~1   JPE", 0x00, true},
+		{"Long File Name.html", "LONGFI~1HTM", 0x00, true},
+		{"Long File Names.html", "LONGFI~2HTM", 0x00, true},
+		{".bashrc", "BASHRC~1   ", 0x00, true},
+		{"café", "CAF_~1     ", 0x00, true},
+		{"README.txt", "README~1TXT", 0x00, true},
+		{"foo.", "FOO        ", 0x00, true},
+		{"Makefile.html", "MAKEFI~1HTM", 0x00, true},
+	}
+
+	dir := &Directory{}
+	for _, test := range tests {
+		dir.Files = append(dir.Files, DirEntryFile{
+			DirEntryCommon: DirEntryCommon{Name: test.name},
+		})
+	}
+
+	got := dir.shortNames()
+	for i, test := range tests {
+		sn := got[i]
+		if string(sn.Name[:]) != test.expected || sn.CaseFlags != test.flags || sn.NeedsLFN != test.needsLFN {
+			t.Errorf(
+				"%q has short name %q, flags 0x%02x, LFN %t; want %q, 0x%02x, %t",
+				test.name, sn.Name, sn.CaseFlags, sn.NeedsLFN,
+				test.expected, test.flags, test.needsLFN,
+			)
+		}
+	}
+}
+
+func TestShortNamesHashedTails(t *testing.T) {
+	dir := &Directory{}
+	for i := 0; i < 2000; i++ {
+		dir.Files = append(dir.Files, DirEntryFile{
+			DirEntryCommon: DirEntryCommon{Name: fmt.Sprintf("Long File Name %d.html", i)},
+		})
+	}
+
+	// After the first few numeric tails, the rest have a hashed basis.
+	hashed := regexp.MustCompile(`^LO[0-9A-F]{4}~[1-9]HTM$|^LO[0-9A-F]{3}~[1-9][0-9]HTM$`)
+	seen := make(map[[11]byte]bool)
+	for i, sn := range dir.shortNames() {
+		if seen[sn.Name] {
+			t.Errorf("short name %q is used more than once", sn.Name)
+		}
+		seen[sn.Name] = true
+
+		if i < maxNumericTail {
+			if want := fmt.Sprintf("LONGFI~%dHTM", i+1); string(sn.Name[:]) != want {
+				t.Errorf("name %d has short name %q; want %q", i, sn.Name, want)
+			}
+		} else if !hashed.Match(sn.Name[:]) {
+			t.Errorf("name %d has short name %q; want a hashed basis", i, sn.Name)
+		}
+	}
+}
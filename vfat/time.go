@@ -0,0 +1,78 @@
+package vfat
+
+import (
+	"fmt"
+	"time"
+)
+
+// The range of times that can be represented in a directory entry. FAT
+// records times in two-second increments (with an additional 10ms field
+// for creation times only) and years as an offset from 1980 in seven bits.
+const minDOSYear = 1980
+const maxDOSYear = 2107
+
+// TimeRangeError is the error used when a timestamp falls outside of the
+// range that can be recorded in a directory entry.
+type TimeRangeError struct {
+	Name string
+	Time time.Time
+}
+
+func (err *TimeRangeError) Error() string {
+	return fmt.Sprintf(
+		"%s has time %s, which is outside of the range %d through %d",
+		err.Name, err.Time, minDOSYear, maxDOSYear,
+	)
+}
+
+// dosTimeRange returns the earliest and latest times that can be recorded
+// in a directory entry for the given location.
+func dosTimeRange(loc *time.Location) (time.Time, time.Time) {
+	return time.Date(minDOSYear, 1, 1, 0, 0, 0, 0, loc),
+		time.Date(maxDOSYear, 12, 31, 23, 59, 59, 990*int(time.Millisecond), loc)
+}
+
+// encodeDOSTime converts a time into the date, time and 10ms fields used
+// in directory entries, after first converting it into the given location.
+// If loc is nil, the time's own location is used.
+//
+// Times outside of the representable range are clamped to it, with inRange
+// set to false. The zero time produces all-zero fields, meaning "not
+// recorded", and is considered to be in range.
+func encodeDOSTime(t time.Time, loc *time.Location) (date, tod uint16, tenMillis uint8, inRange bool) {
+	if t.IsZero() {
+		return 0, 0, 0, true
+	}
+	if loc != nil {
+		t = t.In(loc)
+	}
+
+	inRange = true
+	min, max := dosTimeRange(t.Location())
+	if t.Before(min) {
+		t, inRange = min, false
+	} else if t.After(max) {
+		t, inRange = max, false
+	}
+
+	date = uint16(t.Year()-minDOSYear)<<9 | uint16(t.Month())<<5 | uint16(t.Day())
+	tod = uint16(t.Hour())<<11 | uint16(t.Minute())<<5 | uint16(t.Second()/2)
+	tenMillis = uint8((t.Second()%2)*100 + t.Nanosecond()/(10*int(time.Millisecond)))
+	return date, tod, tenMillis, inRange
+}
+
+// decodeDOSTime converts the date, time and 10ms fields used in directory
+// entries into a time in the given location.
+//
+// A zero date means that no time was recorded, and produces a zero time.
+func decodeDOSTime(date, tod uint16, tenMillis uint8, loc *time.Location) time.Time {
+	if date == 0 {
+		return time.Time{}
+	}
+	return time.Date(
+		minDOSYear+int(date>>9), time.Month((date>>5)&0x0f), int(date&0x1f),
+		int(tod>>11), int((tod>>5)&0x3f), int(tod&0x1f)*2+int(tenMillis/100),
+		int(tenMillis%100)*10*int(time.Millisecond),
+		loc,
+	)
+}
@@ -0,0 +1,91 @@
+package vfat
+
+import (
+	"testing"
+	"time"
+
+	"github.com/apparentlymart/go-fsutil/fsutil"
+)
+
+func TestEncodeDOSTime(t *testing.T) {
+	est := time.FixedZone("EST", -5*60*60)
+
+	type test struct {
+		t         time.Time
+		loc       *time.Location
+		date      uint16
+		tod       uint16
+		tenMillis uint8
+		inRange   bool
+	}
+
+	tests := []test{
+		{
+			time.Time{}, nil,
+			0x0000, 0x0000, 0, true,
+		},
+		{
+			time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC), nil,
+			0x0021, 0x0000, 0, true,
+		},
+		{
+			time.Date(2016, 7, 4, 13, 45, 31, 250*int(time.Millisecond), time.UTC), nil,
+			0x48e4, 0x6daf, 125, true,
+		},
+		{
+			// Converted to EST before encoding, so becomes 08:45:31
+			time.Date(2016, 7, 4, 13, 45, 31, 0, time.UTC), est,
+			0x48e4, 0x45af, 100, true,
+		},
+		{
+			time.Date(1979, 12, 31, 23, 59, 59, 0, time.UTC), nil,
+			0x0021, 0x0000, 0, false,
+		},
+		{
+			time.Date(2108, 1, 1, 0, 0, 0, 0, time.UTC), nil,
+			0xff9f, 0xbf7d, 199, false,
+		},
+	}
+
+	for _, test := range tests {
+		date, tod, tenMillis, inRange := encodeDOSTime(test.t, test.loc)
+		if date != test.date || tod != test.tod || tenMillis != test.tenMillis || inRange != test.inRange {
+			t.Errorf(
+				"encoding %s gives 0x%04x, 0x%04x, %d, %t; want 0x%04x, 0x%04x, %d, %t",
+				test.t, date, tod, tenMillis, inRange,
+				test.date, test.tod, test.tenMillis, test.inRange,
+			)
+		}
+	}
+}
+
+func TestDOSTimeRoundTrip(t *testing.T) {
+	want := time.Date(2016, 7, 4, 13, 45, 31, 250*int(time.Millisecond), time.UTC)
+	date, tod, tenMillis, _ := encodeDOSTime(want, nil)
+	got := decodeDOSTime(date, tod, tenMillis, time.UTC)
+	if !got.Equal(want) {
+		t.Errorf("round-trip of %s gives %s", want, got)
+	}
+}
+
+func TestBuildStrictTimes(t *testing.T) {
+	fs := &Filesystem{
+		StrictTimes: true,
+		RootDir: &Directory{
+			Dirs: []DirEntryDir{
+				{
+					DirEntryCommon: DirEntryCommon{
+						Name:             "old",
+						LastModifiedTime: time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC),
+					},
+					Directory: &Directory{},
+				},
+			},
+		},
+	}
+
+	err := fs.Build(fsutil.RegionForBytes(make([]byte, fs.Length())))
+	if _, ok := err.(*TimeRangeError); !ok {
+		t.Errorf("Build returned %#v; want a *TimeRangeError", err)
+	}
+}